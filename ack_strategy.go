@@ -0,0 +1,134 @@
+package rabbus
+
+import (
+	"sync"
+	"time"
+)
+
+// AckStrategy decides when and how the deliveries handed to a handler are acknowledged in AutoAck mode.
+// A strategy belongs to a single consumer, which calls it from one goroutine at a time, unless handling
+// the messages concurrently, and calls Flush whenever its deliveries stop, e.g. on a reconnect.
+type AckStrategy interface {
+	// Received is called with every message, before handling it.
+	Received(m ConsumerMessage)
+	// Handled is called with every message handled and the handler result.
+	Handled(m ConsumerMessage, err error)
+	// Flush acknowledges the messages the strategy is holding.
+	Flush()
+}
+
+// AckImmediately acks each message as soon as it is received, whatever the handler result. Messages are
+// processed at most once: the ones being handled when the process crashes are lost.
+func AckImmediately() AckStrategy {
+	return ackImmediately{}
+}
+
+type ackImmediately struct{}
+
+func (ackImmediately) Received(m ConsumerMessage) { m.Ack(false) }
+
+func (ackImmediately) Handled(ConsumerMessage, error) {}
+
+func (ackImmediately) Flush() {}
+
+// AckAfterHandler settles each message once handled, as described by AutoAck. Messages are processed
+// at least once: the ones being handled when the process crashes are redelivered. It is the default strategy.
+func AckAfterHandler() AckStrategy {
+	return ackAfterHandler{}
+}
+
+type ackAfterHandler struct{}
+
+func (ackAfterHandler) Received(ConsumerMessage) {}
+
+func (ackAfterHandler) Handled(m ConsumerMessage, err error) { settle(m, err) }
+
+func (ackAfterHandler) Flush() {}
+
+// AckBatch acks the handled messages together, every size successfully handled messages, saving round-trips
+// at the cost of redelivering up to size messages already handled when the process crashes. Failed messages
+// are settled right away, once the handled ones before them are acked. The messages must be handled
+// in order, so ListenWithHandler returns ErrUnorderedAck along with ListenConfig.Concurrency. The broker stops
+// delivering once ListenConfig.PrefetchCount messages are not acked, so ListenWithHandler returns
+// ErrInvalidAckStrategy when size is not positive or exceeds it.
+func AckBatch(size int) AckStrategy {
+	return &ackDeferred{size: size}
+}
+
+// AckInterval acks the handled messages together, every interval, with the same implications as AckBatch
+// for the messages handled during the last interval. ListenWithHandler returns ErrInvalidAckStrategy
+// when interval is not positive.
+func AckInterval(interval time.Duration) AckStrategy {
+	return &ackDeferred{interval: interval}
+}
+
+// ackDeferred holds the last successfully handled message, acking it and all the ones before it at once.
+type ackDeferred struct {
+	sync.Mutex
+	size     int
+	interval time.Duration
+	last     *ConsumerMessage
+	count    int
+	timer    *time.Timer
+	// logf reports the acks failing, it is set by ListenWithHandler.
+	logf func(format string, args ...interface{})
+}
+
+// validate returns ErrInvalidAckStrategy unless a acks before prefetchCount messages are held, zero meaning no limit.
+func (a *ackDeferred) validate(prefetchCount int) error {
+	if a.size < 0 || a.interval < 0 || (a.size == 0 && a.interval == 0) {
+		return ErrInvalidAckStrategy
+	}
+
+	if a.interval == 0 && prefetchCount > 0 && a.size > prefetchCount {
+		return ErrInvalidAckStrategy
+	}
+
+	return nil
+}
+
+func (a *ackDeferred) Received(ConsumerMessage) {}
+
+func (a *ackDeferred) Handled(m ConsumerMessage, err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if err != nil {
+		a.flush()
+		settle(m, err)
+		return
+	}
+
+	a.last = &m
+	a.count++
+
+	if a.size > 0 && a.count >= a.size {
+		a.flush()
+		return
+	}
+
+	if a.interval > 0 && a.timer == nil {
+		a.timer = time.AfterFunc(a.interval, a.Flush)
+	}
+}
+
+func (a *ackDeferred) Flush() {
+	a.Lock()
+	defer a.Unlock()
+	a.flush()
+}
+
+func (a *ackDeferred) flush() {
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+
+	if a.last != nil {
+		if err := a.last.Ack(true); err != nil && a.logf != nil {
+			a.logf("rabbus: %d messages up to delivery tag %d failed to be acknowledged: %s", a.count, a.last.DeliveryTag, err)
+		}
+	}
+
+	a.last, a.count = nil, 0
+}
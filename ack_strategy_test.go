@@ -0,0 +1,77 @@
+package rabbus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestAckBatch(t *testing.T) {
+	ack := &acknowledger{}
+	strategy := AckBatch(3)
+
+	message := func(tag uint64) ConsumerMessage {
+		return newConsumerMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: tag}, nil)
+	}
+
+	for tag := uint64(1); tag <= 2; tag++ {
+		strategy.Handled(message(tag), nil)
+	}
+
+	if ack.acks != 0 {
+		t.Fatalf("Expected no acks before the batch is full, got %d", ack.acks)
+	}
+
+	strategy.Handled(message(3), nil)
+	if ack.acks != 1 || ack.last != "ack" {
+		t.Fatalf("Expected the batch to be acked at once, got %d %s", ack.acks, ack.last)
+	}
+
+	strategy.Handled(message(4), nil)
+	strategy.Handled(message(5), errors.New("failed"))
+	if ack.acks != 3 || ack.last != "requeue" {
+		t.Fatalf("Expected the pending message to be acked before requeueing the failed one, got %d %s", ack.acks, ack.last)
+	}
+
+	strategy.Flush()
+	if ack.acks != 3 {
+		t.Fatalf("Expected nothing left to flush, got %d acks", ack.acks)
+	}
+}
+
+func TestListenWithHandlerRefusesUnorderedAck(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	handler := func(ConsumerMessage) error { return nil }
+
+	for _, strategy := range []AckStrategy{AckBatch(10), AckInterval(time.Second)} {
+		c := ListenConfig{Exchange: "test_ex", Kind: "direct", Queue: "test_q", AckStrategy: strategy, Concurrency: 2}
+		if _, err := r.ListenWithHandler(c, handler); err != ErrUnorderedAck {
+			t.Errorf("Expected ErrUnorderedAck for %T, got %v", strategy, err)
+		}
+	}
+}
+
+func TestListenWithHandlerRefusesAckNever(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	handler := func(ConsumerMessage) error { return nil }
+
+	cases := []struct {
+		strategy AckStrategy
+		prefetch int
+	}{
+		{AckBatch(0), 0},
+		{AckBatch(-1), 0},
+		{AckBatch(20), 0},
+		{AckBatch(20), 10},
+		{AckInterval(0), 0},
+	}
+
+	for _, test := range cases {
+		c := ListenConfig{Exchange: "test_ex", Kind: "direct", Queue: "test_q", AckStrategy: test.strategy, PrefetchCount: test.prefetch}
+		if _, err := r.ListenWithHandler(c, handler); err != ErrInvalidAckStrategy {
+			t.Errorf("Expected ErrInvalidAckStrategy for %+v with prefetch %d, got %v", test.strategy, test.prefetch, err)
+		}
+	}
+}
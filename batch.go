@@ -0,0 +1,224 @@
+package rabbus
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sony/gobreaker"
+	"github.com/streadway/amqp"
+)
+
+// EmitBatch publishes msgs in order on the producer channel within a single circuit breaker execution
+// and waits for all of them, the broker confirms included when confirms are enabled, which are awaited
+// once every message is published. The batch bypasses an open breaker if any of its messages is critical.
+// When a message fails, the error is a *BatchError telling how many messages before it were published.
+func (r *rabbus) EmitBatch(msgs []Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	_, err := r.do(func(l *lane, done published) {
+		l.sendBatch(msgs, done)
+	})
+	return err
+}
+
+// batched is a message of a batch ready to be published.
+type batched struct {
+	m    Message
+	pub  amqp.Publishing
+	done published
+}
+
+// sendBatch prepares every message of msgs and publishes them, reporting the batch result to done
+// once the result of every message is known.
+func (l *lane) sendBatch(msgs []Message, done published) {
+	res := &batchResult{pending: len(msgs), done: done}
+
+	batch := make([]batched, 0, len(msgs))
+	fail := func(from int, err error) {
+		for _, b := range batch {
+			b.done(Receipt{}, err)
+		}
+		for i := from; i < len(msgs); i++ {
+			res.report(i)(Receipt{}, err)
+		}
+	}
+
+	critical := false
+	for i, m := range msgs {
+		m, pub, err := l.prepare(context.Background(), m, true)
+		if err != nil {
+			fail(i, err)
+			return
+		}
+
+		critical = critical || m.Critical
+		batch = append(batch, batched{m: m, pub: pub, done: l.observe(m.Exchange, l.onPublished(m, res.report(i)))})
+	}
+
+	if !critical && l.breaker.State() == gobreaker.StateOpen {
+		fail(len(msgs), ErrCircuitOpen)
+		return
+	}
+
+	if err := l.waitUnblocked(); err != nil {
+		fail(len(msgs), err)
+		return
+	}
+
+	l.publishBatch(batch, critical)
+}
+
+// publishBatch publishes batch through the circuit breaker, retrying each publishing, and reports
+// the result of each message, once confirmed by the broker when confirms are enabled.
+func (l *lane) publishBatch(batch []batched, critical bool) {
+	confirms, acks := l.confirms, l.acks
+
+	// the confirms are read while publishing, the broker does not wait for them to be consumed.
+	var total chan int
+	collected := make(chan []amqp.Confirmation, 1)
+	if acks != nil {
+		total = make(chan int, 1)
+		go collectConfirms(acks, total, collected)
+	}
+
+	var (
+		sent       int
+		confirmed  []amqp.Confirmation
+		collecting = acks != nil
+	)
+	collect := func() {
+		if collecting {
+			collecting = false
+			total <- sent
+			confirmed = <-collected
+		}
+	}
+
+	publish := func() error {
+		for ; sent < len(batch); sent++ {
+			b := &batch[sent]
+
+			var tag uint64
+			if confirms != nil {
+				tag = confirms.add(b.done)
+			}
+
+			err := l.retryAttempts(func(attempt int) error {
+				err := l.ch.Publish(b.m.Exchange, b.m.Key, l.config.Mandatory, false, b.pub)
+				if err != nil {
+					l.config.logf("rabbus: attempt %d publishing to exchange %q with key %q failed: %s", attempt, b.m.Exchange, b.m.Key, err)
+				}
+				return err
+			})
+			if err != nil {
+				if confirms != nil && !confirms.remove(tag) {
+					// already settled along with the channel.
+					b.done = nil
+				}
+				collect()
+				return err
+			}
+		}
+
+		collect()
+		for _, c := range confirmed {
+			if !c.Ack {
+				return ErrNacked
+			}
+		}
+		if len(confirmed) < sent && acks != nil {
+			return ErrConfirmLost
+		}
+
+		return nil
+	}
+
+	_, err := l.breaker.Execute(func() (interface{}, error) {
+		return nil, publish()
+	})
+	if critical && isBreakerRejection(err) {
+		err = publish()
+	}
+	collect()
+
+	if err == gobreaker.ErrOpenState {
+		err = ErrCircuitOpen
+	}
+
+	if confirms == nil {
+		for i := 0; i < sent; i++ {
+			switch {
+			case acks == nil:
+				batch[i].done(l.receipt(0), nil)
+			case i >= len(confirmed):
+				batch[i].done(Receipt{}, ErrConfirmLost)
+			case !confirmed[i].Ack:
+				batch[i].done(l.receipt(confirmed[i].DeliveryTag), ErrNacked)
+			default:
+				batch[i].done(l.receipt(confirmed[i].DeliveryTag), nil)
+			}
+		}
+	}
+
+	for i := sent; i < len(batch); i++ {
+		if batch[i].done != nil {
+			batch[i].done(Receipt{}, err)
+		}
+	}
+}
+
+// collectConfirms reads the confirms of the publishings of a batch from acks until it gets
+// as many as the total of publishings, or acks is closed along with the channel.
+func collectConfirms(acks <-chan amqp.Confirmation, total <-chan int, collected chan<- []amqp.Confirmation) {
+	var confirms []amqp.Confirmation
+	n := -1
+	for n < 0 || len(confirms) < n {
+		select {
+		case c, ok := <-acks:
+			if !ok {
+				collected <- confirms
+				return
+			}
+			confirms = append(confirms, c)
+		case n = <-total:
+			total = nil
+		}
+	}
+
+	collected <- confirms
+}
+
+// batchResult collects the results of the messages of a batch, reporting the first failure,
+// in publishing order, to done once every result is known.
+type batchResult struct {
+	sync.Mutex
+	pending int
+	failed  int
+	err     error
+	done    published
+}
+
+// report returns the func reporting the result of the i-th message of the batch.
+func (b *batchResult) report(i int) published {
+	return func(_ Receipt, err error) {
+		b.Lock()
+		if err != nil && (b.err == nil || i < b.failed) {
+			b.failed, b.err = i, err
+		}
+		b.pending--
+		last := b.pending == 0
+		b.Unlock()
+
+		if !last {
+			return
+		}
+
+		if b.err != nil {
+			b.done(Receipt{}, &BatchError{Sent: b.failed, Err: b.err})
+			return
+		}
+		b.done(Receipt{}, nil)
+	}
+}
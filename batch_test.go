@@ -0,0 +1,117 @@
+package rabbus
+
+import (
+	"testing"
+	"time"
+)
+
+func testBatch(n int) []Message {
+	msgs := make([]Message, n)
+	for i := range msgs {
+		msgs[i] = Message{Exchange: "test_ex", Kind: "direct", Key: "test_key", Payload: []byte{byte(i)}}
+	}
+	return msgs
+}
+
+func sendBatch(t *testing.T, r *lane, msgs []Message) error {
+	res := make(chan error, 1)
+	r.sendBatch(msgs, func(_ Receipt, err error) { res <- err })
+
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("Expected the batch result")
+		return nil
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+
+	if err := sendBatch(t, r, testBatch(3)); err != nil {
+		t.Fatalf("Expected to send the batch %s", err)
+	}
+
+	if len(ch.declared) != 1 || len(ch.published) != 3 {
+		t.Fatalf("Expected 1 declare and 3 publishings, got %d and %d", len(ch.declared), len(ch.published))
+	}
+
+	for i, p := range ch.published {
+		if p.pub.Body[0] != byte(i) {
+			t.Errorf("Expected the messages published in order, got %d at %d", p.pub.Body[0], i)
+		}
+	}
+}
+
+func TestSendBatchFailures(t *testing.T) {
+	invalid := testBatch(3)
+	invalid[1].Kind = ""
+
+	tests := []struct {
+		scenario string
+		ch       *fakeChannel
+		config   Config
+		msgs     []Message
+		sent     int
+		err      error
+	}{
+		{"invalid message", &fakeChannel{}, Config{Attempts: 1}, invalid, 0, ErrMissingKind},
+		{"publishing", &fakeChannel{limit: 2}, Config{Attempts: 2}, testBatch(3), 2, nil},
+		{"nack", &fakeChannel{nack: 1}, Config{Attempts: 1, EnablePublisherConfirms: true}, testBatch(3), 0, ErrNacked},
+		{"pipelined nack", &fakeChannel{nack: 1}, Config{Attempts: 1, ConfirmBatchWindow: time.Millisecond}, testBatch(3), 0, ErrNacked},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			r := newTestRabbus(test.ch, test.config)
+			r.trackConfirms(test.ch)
+
+			err := sendBatch(t, r, test.msgs)
+			be, ok := err.(*BatchError)
+			if !ok {
+				t.Fatalf("Expected a *BatchError, got %v", err)
+			}
+
+			if be.Sent != test.sent || (test.err != nil && be.Err != test.err) {
+				t.Errorf("Expected %d messages sent before %v, got %d before %v", test.sent, test.err, be.Sent, be.Err)
+			}
+		})
+	}
+}
+
+func TestSendBatchWaitsForConfirms(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1, EnablePublisherConfirms: true})
+	r.trackConfirms(ch)
+
+	var tags []uint64
+	msgs := testBatch(3)
+	r.config.OnPublished = func(Message) { tags = append(tags, ch.tag) }
+
+	if err := sendBatch(t, r, msgs); err != nil {
+		t.Fatalf("Expected to send the batch %s", err)
+	}
+
+	if len(tags) != 3 || ch.tag != 3 {
+		t.Errorf("Expected the 3 messages to be confirmed, got %v", tags)
+	}
+}
+
+func TestBatchResultReportsFirstFailure(t *testing.T) {
+	var err error
+	res := &batchResult{pending: 3, done: func(_ Receipt, e error) { err = e }}
+
+	res.report(2)(Receipt{}, ErrNacked)
+	res.report(1)(Receipt{}, ErrConfirmLost)
+	if err != nil {
+		t.Fatalf("Expected no result before every message is settled, got %v", err)
+	}
+
+	res.report(0)(Receipt{}, nil)
+	be, ok := err.(*BatchError)
+	if !ok || be.Sent != 1 || be.Err != ErrConfirmLost {
+		t.Errorf("Expected the first failed message in publishing order, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package rabbus
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Codec marshals and unmarshals message payloads of a given content-type.
+type Codec interface {
+	// ContentType returns the content-type the codec is registered under.
+	ContentType() string
+	// Marshal returns the encoding of v.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal parses the encoded data and stores the result in the value pointed to by v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// ValueCodec is implemented by codecs which only handle values of specific types, letting EmitValue
+// pick them by the value being emitted when the message content-type is not set.
+type ValueCodec interface {
+	Codec
+	// Accepts reports whether the codec is able to marshal v.
+	Accepts(v interface{}) bool
+}
+
+// Encoder encodes the values emitted by EmitValue, returning the payload along with its content-type.
+type Encoder interface {
+	Encode(v interface{}) ([]byte, string, error)
+}
+
+// CodecEncoder returns an Encoder marshaling every value with c, e.g. a registered codec.
+func CodecEncoder(c Codec) Encoder {
+	return codecEncoder{c}
+}
+
+type codecEncoder struct {
+	codec Codec
+}
+
+func (e codecEncoder) Encode(v interface{}) ([]byte, string, error) {
+	payload, err := e.codec.Marshal(v)
+	return payload, e.codec.ContentType(), err
+}
+
+var (
+	codecsMu    sync.RWMutex
+	codecs      = map[string]Codec{ContentTypeJSON: jsonCodec{}}
+	valueCodecs []ValueCodec
+)
+
+// RegisterCodec makes c available under its content-type, replacing any codec previously
+// registered for the same content-type. It is usually called from the init function of the
+// package implementing the codec.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[c.ContentType()] = c
+	if vc, ok := c.(ValueCodec); ok {
+		for i := range valueCodecs {
+			if valueCodecs[i].ContentType() == vc.ContentType() {
+				valueCodecs[i] = vc
+				return
+			}
+		}
+		valueCodecs = append(valueCodecs, vc)
+	}
+}
+
+// codecFor returns the codec registered for contentType, messages without
+// content-type are assumed to be JSON as it is the default when emitting.
+func codecFor(contentType string) (Codec, error) {
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[contentType]
+	if !ok {
+		return nil, ErrUnknownContentType
+	}
+
+	return c, nil
+}
+
+// codecForValue returns the first registered ValueCodec accepting v, falling back to JSON.
+func codecForValue(v interface{}) Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	for _, c := range valueCodecs {
+		if c.Accepts(v) {
+			return c
+		}
+	}
+
+	return codecs[ContentTypeJSON]
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
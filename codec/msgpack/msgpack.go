@@ -0,0 +1,37 @@
+// Package msgpack registers a rabbus codec for MessagePack payloads.
+// Import it for its side effect and emit values with the msgpack content-type:
+//
+//	import _ "github.com/rafaeljesus/rabbus/codec/msgpack"
+//
+//	r.EmitMessageValue(rabbus.Message{ContentType: msgpack.ContentType, ...}, v)
+package msgpack
+
+import (
+	"github.com/rafaeljesus/rabbus"
+	"github.com/vmihailenco/msgpack"
+)
+
+// ContentType is the content-type MessagePack payloads are published with.
+const ContentType = "application/x-msgpack"
+
+func init() {
+	rabbus.RegisterCodec(Codec{})
+}
+
+// Codec marshals and unmarshals values using MessagePack.
+type Codec struct{}
+
+// ContentType returns the MessagePack content-type.
+func (Codec) ContentType() string {
+	return ContentType
+}
+
+// Marshal returns the MessagePack encoding of v.
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Unmarshal parses the MessagePack encoded data into the value pointed to by v.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,30 @@
+package msgpack
+
+import "testing"
+
+type order struct {
+	ID    int
+	Items []string
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	var c Codec
+	if c.ContentType() != ContentType {
+		t.Fatalf("Expected content-type %s, got %s", ContentType, c.ContentType())
+	}
+
+	in := order{ID: 1, Items: []string{"book", "pen"}}
+	data, err := c.Marshal(in)
+	if err != nil {
+		t.Fatalf("Expected to marshal value %s", err)
+	}
+
+	var out order
+	if err := c.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Expected to unmarshal value %s", err)
+	}
+
+	if out.ID != in.ID || len(out.Items) != 2 || out.Items[0] != "book" || out.Items[1] != "pen" {
+		t.Errorf("Expected %+v, got %+v", in, out)
+	}
+}
@@ -0,0 +1,56 @@
+// Package protobuf registers a rabbus codec for protocol buffers messages.
+// Import it for its side effect and emit proto.Message values with EmitValue:
+//
+//	import _ "github.com/rafaeljesus/rabbus/codec/protobuf"
+package protobuf
+
+import (
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rafaeljesus/rabbus"
+)
+
+// ContentType is the content-type protocol buffers messages are published with.
+const ContentType = "application/x-protobuf"
+
+// ErrNotProtoMessage is returned when the value is not a proto.Message.
+var ErrNotProtoMessage = errors.New("Value is not a proto.Message")
+
+func init() {
+	rabbus.RegisterCodec(Codec{})
+}
+
+// Codec marshals and unmarshals proto.Message values.
+type Codec struct{}
+
+// ContentType returns the protocol buffers content-type.
+func (Codec) ContentType() string {
+	return ContentType
+}
+
+// Accepts reports whether v is a proto.Message.
+func (Codec) Accepts(v interface{}) bool {
+	_, ok := v.(proto.Message)
+	return ok
+}
+
+// Marshal returns the wire-format encoding of v, which must be a proto.Message.
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+
+	return proto.Marshal(m)
+}
+
+// Unmarshal parses the wire-format encoded data into v, which must be a proto.Message.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+
+	return proto.Unmarshal(data, m)
+}
@@ -0,0 +1,45 @@
+package protobuf
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	var c Codec
+	in := &wrappers.StringValue{Value: "order created"}
+	if !c.Accepts(in) {
+		t.Fatal("Expected proto messages to be accepted")
+	}
+
+	data, err := c.Marshal(in)
+	if err != nil {
+		t.Fatalf("Expected to marshal message %s", err)
+	}
+
+	out := &wrappers.StringValue{}
+	if err := c.Unmarshal(data, out); err != nil {
+		t.Fatalf("Expected to unmarshal message %s", err)
+	}
+
+	if out.Value != in.Value {
+		t.Errorf("Expected %q, got %q", in.Value, out.Value)
+	}
+}
+
+func TestCodecRefusesOtherValues(t *testing.T) {
+	var c Codec
+	if c.Accepts("order") {
+		t.Error("Expected values other than proto messages to be refused")
+	}
+
+	if _, err := c.Marshal("order"); err != ErrNotProtoMessage {
+		t.Errorf("Expected ErrNotProtoMessage, got %v", err)
+	}
+
+	var s string
+	if err := c.Unmarshal(nil, &s); err != ErrNotProtoMessage {
+		t.Errorf("Expected ErrNotProtoMessage, got %v", err)
+	}
+}
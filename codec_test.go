@@ -0,0 +1,175 @@
+package rabbus
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+type stringCodec struct{}
+
+func (stringCodec) ContentType() string { return "text/x-test" }
+
+func (stringCodec) Accepts(v interface{}) bool {
+	_, ok := v.(string)
+	return ok
+}
+
+func (stringCodec) Marshal(v interface{}) ([]byte, error) { return []byte(v.(string)), nil }
+
+func (stringCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*string) = string(data)
+	return nil
+}
+
+func TestCodecForValue(t *testing.T) {
+	RegisterCodec(stringCodec{})
+
+	if c := codecForValue("foo"); c.ContentType() != "text/x-test" {
+		t.Errorf("Expected string values to use the registered value codec, got %s", c.ContentType())
+	}
+
+	if c := codecForValue(map[string]int{"foo": 1}); c.ContentType() != ContentTypeJSON {
+		t.Errorf("Expected other values to fall back to json, got %s", c.ContentType())
+	}
+}
+
+type textCodec struct{}
+
+func (textCodec) ContentType() string { return "text/plain" }
+
+func (textCodec) Marshal(v interface{}) ([]byte, error) { return []byte(v.(string)), nil }
+
+func (textCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*string) = string(data)
+	return nil
+}
+
+func TestValueCodec(t *testing.T) {
+	RegisterCodec(stringCodec{})
+
+	tests := []struct {
+		scenario string
+		config   Config
+		m        Message
+		want     string
+	}{
+		{"registered value codec", Config{}, Message{}, "text/x-test"},
+		{"config codec", Config{Codec: textCodec{}}, Message{}, "text/plain"},
+		{"config codec content-type", Config{Codec: textCodec{}}, Message{ContentType: "text/plain"}, "text/plain"},
+		{"message content-type", Config{Codec: textCodec{}}, Message{ContentType: ContentTypeJSON}, ContentTypeJSON},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			r := newTestRabbus(&fakeChannel{}, test.config)
+			c, err := r.valueCodec(test.m, "foo")
+			if err != nil || c.ContentType() != test.want {
+				t.Errorf("Expected the %s codec, got %v %v", test.want, c, err)
+			}
+		})
+	}
+
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	if _, err := r.valueCodec(Message{ContentType: "application/x-unknown"}, "foo"); err != ErrUnknownContentType {
+		t.Errorf("Expected ErrUnknownContentType, got %v", err)
+	}
+}
+
+func TestEmitValue(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{
+		Attempts:      1,
+		EmitResults:   true,
+		Encoder:       CodecEncoder(textCodec{}),
+		ExchangeKinds: map[string]string{"test_ex": "direct"},
+	})
+	r.emit = make(chan Message)
+	r.results = make(chan EmitResult, 1)
+	go r.register()
+	defer close(r.closed)
+
+	if err := r.EmitValue("test_ex", "test_key", "foo"); err != nil {
+		t.Fatalf("Expected the value to be accepted, got %v", err)
+	}
+
+	if res := <-r.EmitResults(); res.Err != nil {
+		t.Fatalf("Expected the value to be sent, got %v", res.Err)
+	}
+
+	got := ch.published[0]
+	if got.exchange != "test_ex" || got.key != "test_key" || got.pub.ContentType != "text/plain" || string(got.pub.Body) != "foo" {
+		t.Errorf("Expected the value encoded as text/plain, got %+v", got)
+	}
+
+	if len(ch.declared) != 1 || ch.declared[0] != "test_ex" {
+		t.Errorf("Expected the exchange to be declared, got %v", ch.declared)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		scenario string
+		config   Config
+		m        Message
+		want     string
+	}{
+		{"config codec", Config{Codec: jsonCodec{}}, Message{}, ContentTypeJSON},
+		{"config encoder", Config{Encoder: CodecEncoder(textCodec{}), Codec: jsonCodec{}}, Message{}, "text/plain"},
+		{"message content-type", Config{Encoder: CodecEncoder(textCodec{})}, Message{ContentType: ContentTypeJSON}, ContentTypeJSON},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			r := newTestRabbus(&fakeChannel{}, test.config)
+			_, contentType, err := r.encode(test.m, "foo")
+			if err != nil || contentType != test.want {
+				t.Errorf("Expected the %s encoding, got %s %v", test.want, contentType, err)
+			}
+		})
+	}
+}
+
+func TestConsumerMessageUnmarshal(t *testing.T) {
+	var v struct{ Foo string }
+	cm := ConsumerMessage{ContentType: ContentTypeJSON, Body: []byte(`{"Foo":"bar"}`)}
+	if err := cm.Unmarshal(&v); err != nil || v.Foo != "bar" {
+		t.Errorf("Expected to unmarshal json body, got %v %v", v, err)
+	}
+
+	cm = ConsumerMessage{ContentType: "application/x-unknown"}
+	if err := cm.Unmarshal(&v); err != ErrUnknownContentType {
+		t.Errorf("Expected unknown content type error, got %v", err)
+	}
+
+	s := newSession()
+	s.codec = textCodec{}
+	var text string
+	cm = newConsumerMessage(amqp.Delivery{ContentType: "text/plain", Body: []byte("foo")}, s)
+	if err := cm.Unmarshal(&text); err != nil || text != "foo" {
+		t.Errorf("Expected to unmarshal with the config codec, got %q %v", text, err)
+	}
+
+	cm = newConsumerMessage(amqp.Delivery{ContentType: ContentTypeJSON, Body: []byte(`{"Foo":"baz"}`)}, s)
+	if err := cm.Unmarshal(&v); err != nil || v.Foo != "baz" {
+		t.Errorf("Expected other content-types to use the registered codecs, got %v %v", v, err)
+	}
+}
+
+func TestConsumerMessageDecode(t *testing.T) {
+	var v struct{ Foo string }
+	cm := newConsumerMessage(amqp.Delivery{ContentType: ContentTypeJSON, Body: []byte(`{"Foo":"bar"}`)}, newSession())
+	if err := cm.Decode(&v); err != nil || v.Foo != "bar" {
+		t.Errorf("Expected to decode json body, got %v %v", v, err)
+	}
+
+	cm = newConsumerMessage(amqp.Delivery{Body: []byte(`{"Foo":"baz"}`)}, newSession())
+	if err := cm.Decode(&v); err != nil || v.Foo != "baz" {
+		t.Errorf("Expected to decode the body without content-type as json, got %v %v", v, err)
+	}
+
+	cm = newConsumerMessage(amqp.Delivery{ContentType: "application/x-unknown", Body: []byte("foo")}, newSession())
+	if err := cm.Decode(&v); err != ErrUnknownContentType {
+		t.Errorf("Expected unknown content type error, got %v", err)
+	}
+}
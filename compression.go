@@ -0,0 +1,71 @@
+package rabbus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// Compression is the algorithm used to compress the message payloads.
+type Compression int
+
+const (
+	// CompressionNone publishes the payloads as they are.
+	CompressionNone Compression = iota
+	// CompressionGzip gzips the payloads, labelling the messages with the gzip content-encoding.
+	CompressionGzip
+)
+
+// ContentEncodingGzip is the content-encoding of gzipped messages.
+const ContentEncodingGzip = "gzip"
+
+const defaultCompressionThreshold = 512
+
+// compress gzips the payload of m when compression is enabled, m has no content-encoding yet
+// and its payload is at least as large as the threshold.
+func (r *rabbus) compress(m *Message) error {
+	threshold := r.config.CompressionThreshold
+	if threshold <= 0 {
+		threshold = defaultCompressionThreshold
+	}
+
+	if r.config.Compression != CompressionGzip || m.ContentEncoding != "" || len(m.Payload) < threshold {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(m.Payload); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	m.Payload = buf.Bytes()
+	m.ContentEncoding = ContentEncodingGzip
+
+	return nil
+}
+
+// Payload returns the message body decompressed according to its content-encoding, e.g. to handle
+// gzipped messages without a codec for their content-type. Returns an error if the body is not valid gzip.
+func (cm *ConsumerMessage) Payload() ([]byte, error) {
+	return cm.body()
+}
+
+// body returns the message body, decompressed according to its content-encoding.
+func (cm *ConsumerMessage) body() ([]byte, error) {
+	// an empty body is never compressed, whatever its content-encoding says.
+	if cm.ContentEncoding != ContentEncodingGzip || len(cm.Body) == 0 {
+		return cm.Body, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(cm.Body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,66 @@
+package rabbus
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressAboveThreshold(t *testing.T) {
+	r := &rabbus{config: Config{Compression: CompressionGzip, CompressionThreshold: 16}}
+
+	small := Message{Payload: []byte(`"foo"`)}
+	if err := r.compress(&small); err != nil {
+		t.Fatalf("Expected to compress message %s", err)
+	}
+
+	if small.ContentEncoding != "" || string(small.Payload) != `"foo"` {
+		t.Fatalf("Expected small payloads to be left as they are, got %q", small.Payload)
+	}
+
+	payload := []byte(`"` + string(bytes.Repeat([]byte("foo"), 100)) + `"`)
+	large := Message{Payload: payload}
+	if err := r.compress(&large); err != nil {
+		t.Fatalf("Expected to compress message %s", err)
+	}
+
+	if large.ContentEncoding != ContentEncodingGzip {
+		t.Fatalf("Expected gzip content-encoding, got %s", large.ContentEncoding)
+	}
+
+	cm := ConsumerMessage{ContentType: ContentTypeJSON, ContentEncoding: large.ContentEncoding, Body: large.Payload}
+	var v string
+	if err := cm.Unmarshal(&v); err != nil {
+		t.Fatalf("Expected to unmarshal message %s", err)
+	}
+
+	if v != string(payload[1:len(payload)-1]) {
+		t.Fatalf("Expected the decompressed payload, got %s", v)
+	}
+}
+
+func TestConsumerMessagePayload(t *testing.T) {
+	r := &rabbus{config: Config{Compression: CompressionGzip, CompressionThreshold: 1}}
+
+	for _, payload := range [][]byte{nil, []byte("foo")} {
+		m := Message{Payload: payload}
+		if err := r.compress(&m); err != nil {
+			t.Fatalf("Expected to compress message %s", err)
+		}
+
+		cm := ConsumerMessage{ContentEncoding: m.ContentEncoding, Body: m.Payload}
+		body, err := cm.Payload()
+		if err != nil || !bytes.Equal(body, payload) {
+			t.Errorf("Expected the payload %q, got %q %v", payload, body, err)
+		}
+	}
+
+	empty := ConsumerMessage{ContentEncoding: ContentEncodingGzip}
+	if body, err := empty.Payload(); err != nil || len(body) != 0 {
+		t.Errorf("Expected an empty gzip message to have an empty payload, got %q %v", body, err)
+	}
+
+	invalid := ConsumerMessage{ContentEncoding: ContentEncodingGzip, Body: []byte("foo")}
+	if _, err := invalid.Payload(); err == nil {
+		t.Error("Expected an invalid gzip body to fail")
+	}
+}
@@ -0,0 +1,179 @@
+package rabbus
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// defaultMaxInFlight is the max number of unconfirmed publishings when Config.MaxInFlight is not set.
+const defaultMaxInFlight = 1024
+
+// confirmer is the part of amqp.Channel needed to track publisher confirms.
+type confirmer interface {
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+}
+
+// confirmTracker pipelines publishings on a channel in confirm mode: messages are published
+// continuously and their results are resolved in batches, every window, as the broker confirms them.
+// The broker settles confirms in publishing order, so the delivery tag of each publishing is
+// the count of publishings done so far on the channel.
+type confirmTracker struct {
+	sync.Mutex
+	// channel identifies the channel in the receipts of its publishings.
+	channel Receipt
+	tag     uint64
+	pending map[uint64]published
+	slots   chan struct{}
+}
+
+// newConfirmTracker tracks the confirms of ch, identified by channel, allowing up to maxInFlight unconfirmed publishings.
+func newConfirmTracker(ch confirmer, channel Receipt, window time.Duration, maxInFlight int) *confirmTracker {
+	if maxInFlight <= 0 {
+		maxInFlight = defaultMaxInFlight
+	}
+
+	t := &confirmTracker{
+		channel: channel,
+		pending: make(map[uint64]published),
+		slots:   make(chan struct{}, maxInFlight),
+	}
+
+	go t.reconcile(ch.NotifyPublish(make(chan amqp.Confirmation, maxInFlight)), window)
+
+	return t
+}
+
+// add records done as the result of the next publishing on the channel, blocking while there are
+// already too many unconfirmed publishings. It returns the delivery tag of the publishing.
+func (t *confirmTracker) add(done published) uint64 {
+	t.slots <- struct{}{}
+
+	t.Lock()
+	defer t.Unlock()
+	t.tag++
+	t.pending[t.tag] = done
+	return t.tag
+}
+
+// remove forgets the publishing with the given tag when it never reached the broker.
+// It reports false if the publishing was already settled, e.g. because the channel was closed.
+func (t *confirmTracker) remove(tag uint64) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.pending[tag]; !ok {
+		return false
+	}
+	delete(t.pending, tag)
+	t.tag--
+	<-t.slots
+	return true
+}
+
+func (t *confirmTracker) reconcile(confirms <-chan amqp.Confirmation, window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+
+	var batch []amqp.Confirmation
+	for {
+		select {
+		case c, ok := <-confirms:
+			if !ok {
+				t.resolve(batch)
+				t.fail(ErrConfirmLost)
+				return
+			}
+			batch = append(batch, c)
+		case <-ticker.C:
+			t.resolve(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// resolve settles the publishings confirmed in batch, in the order they were published.
+func (t *confirmTracker) resolve(batch []amqp.Confirmation) {
+	if len(batch) == 0 {
+		return
+	}
+
+	confirmed := make([]amqp.Confirmation, 0, len(batch))
+	done := make([]published, 0, len(batch))
+
+	t.Lock()
+	for _, c := range batch {
+		fn, ok := t.pending[c.DeliveryTag]
+		if !ok {
+			continue
+		}
+		delete(t.pending, c.DeliveryTag)
+
+		confirmed = append(confirmed, c)
+		done = append(done, fn)
+	}
+	t.Unlock()
+
+	for i, c := range confirmed {
+		<-t.slots
+		if c.Ack {
+			done[i](t.receipt(c.DeliveryTag), nil)
+		} else {
+			done[i](t.receipt(c.DeliveryTag), ErrNacked)
+		}
+	}
+}
+
+// receipt returns the receipt of the publishing with the given tag.
+func (t *confirmTracker) receipt(tag uint64) Receipt {
+	r := t.channel
+	r.Tag = tag
+	return r
+}
+
+// drain waits for every pending publishing to be settled. Nothing may be published meanwhile.
+func (t *confirmTracker) drain() {
+	for i := 0; i < cap(t.slots); i++ {
+		t.slots <- struct{}{}
+	}
+}
+
+// fail settles every pending publishing with err, once the channel is gone they can not be
+// confirmed anymore.
+func (t *confirmTracker) fail(err error) {
+	t.Lock()
+	pending := t.pending
+	t.pending = make(map[uint64]published)
+	t.Unlock()
+
+	tags := make([]uint64, 0, len(pending))
+	for tag := range pending {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	for _, tag := range tags {
+		<-t.slots
+		pending[tag](Receipt{}, err)
+	}
+}
+
+// confirmsEnabled reports whether the producer channel is in confirm mode.
+func confirmsEnabled(c Config) bool {
+	return c.ConfirmBatchWindow > 0 || c.EnablePublisherConfirms
+}
+
+// trackConfirms starts following the confirms of the producer channel ch, pipelined when
+// Config.ConfirmBatchWindow is set, one publishing at a time with Config.EnablePublisherConfirms.
+func (l *lane) trackConfirms(ch confirmer) {
+	l.confirms, l.acks = nil, nil
+
+	switch {
+	case l.config.ConfirmBatchWindow > 0:
+		l.confirms = newConfirmTracker(ch, l.receipt(0), l.config.ConfirmBatchWindow, l.config.MaxInFlight)
+	case l.config.EnablePublisherConfirms:
+		l.acks = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	}
+}
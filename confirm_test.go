@@ -0,0 +1,106 @@
+package rabbus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+type fakeConfirmer struct {
+	confirms chan amqp.Confirmation
+}
+
+func (f *fakeConfirmer) NotifyPublish(c chan amqp.Confirmation) chan amqp.Confirmation {
+	f.confirms = c
+	return c
+}
+
+func TestConfirmTrackerResolvesConfirms(t *testing.T) {
+	ch := &fakeConfirmer{}
+	tracker := newConfirmTracker(ch, Receipt{}, time.Millisecond, 2)
+
+	results := make(chan error, 3)
+	done := func(_ Receipt, err error) { results <- err }
+
+	first := tracker.add(done)
+	second := tracker.add(done)
+	ch.confirms <- amqp.Confirmation{DeliveryTag: first, Ack: true}
+	ch.confirms <- amqp.Confirmation{DeliveryTag: second, Ack: false}
+
+	for _, want := range []error{nil, ErrNacked} {
+		select {
+		case err := <-results:
+			if err != want {
+				t.Fatalf("Expected %v, got %v", want, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected the publishing to be resolved")
+		}
+	}
+
+	third := tracker.add(done)
+	if !tracker.remove(third) {
+		t.Fatal("Expected an unconfirmed publishing to be removed")
+	}
+
+	tracker.add(done)
+	close(ch.confirms)
+
+	select {
+	case err := <-results:
+		if err != ErrConfirmLost {
+			t.Fatalf("Expected %v, got %v", ErrConfirmLost, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the pending publishing to fail")
+	}
+}
+
+func TestConfirmTrackerDrain(t *testing.T) {
+	ch := &fakeConfirmer{}
+	tracker := newConfirmTracker(ch, Receipt{}, time.Millisecond, 2)
+	tag := tracker.add(func(Receipt, error) {})
+
+	drained := make(chan struct{})
+	go func() {
+		tracker.drain()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		t.Fatal("Expected drain to wait for the pending publishing")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	ch.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("Expected drain to return once the publishing is confirmed")
+	}
+}
+
+func TestRenewProducerFailsPendingConfirms(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1, ConfirmBatchWindow: time.Millisecond})
+	r.trackConfirms(&fakeConfirmer{})
+	go r.register()
+	defer r.shutdown(time.Second)
+
+	// a publishing waiting for a confirm from the lost connection.
+	results := make(chan error, 1)
+	r.confirms.add(func(_ Receipt, err error) { results <- err })
+
+	r.renewProducer(&fakeChannel{}, 1)
+
+	select {
+	case err := <-results:
+		if err != ErrConnectionClosed {
+			t.Fatalf("Expected %v, got %v", ErrConnectionClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the pending publishing to fail")
+	}
+}
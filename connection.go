@@ -0,0 +1,143 @@
+package rabbus
+
+import (
+	"crypto/tls"
+	"math/rand"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultHeartbeat = 10 * time.Second
+	defaultLocale    = "en_US"
+	reconnectSleep   = 2 * time.Second
+	// defaultCloseTimeout bounds how long Close waits for the pending publishings.
+	defaultCloseTimeout = 5 * time.Second
+)
+
+// connect dials the broker up to c.DialAttempts times.
+func connect(c Config) (*amqp.Connection, error) {
+	b := newBackoff(c)
+	conn, err := dial(c)
+	for attempt := 1; err != nil && attempt < c.DialAttempts; attempt++ {
+		c.logf("rabbus: dial attempt %d failed: %s", attempt, err)
+		time.Sleep(b.next())
+		conn, err = dial(c)
+	}
+
+	return conn, err
+}
+
+// JitteredBackoff returns a Config.RetryBackoff waiting a random duration up to base, doubling after each
+// attempt up to max, so the retries of many producers are spread over time rather than synchronized.
+func JitteredBackoff(base, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+
+		if d <= 0 {
+			return 0
+		}
+
+		return time.Duration(rand.Int63n(int64(d) + 1))
+	}
+}
+
+// backoff is the wait between connection attempts, starting at Config.ReconnectSleep and
+// doubling after each of them up to Config.ReconnectMaxSleep.
+type backoff struct {
+	sleep, max time.Duration
+}
+
+func newBackoff(c Config) *backoff {
+	b := &backoff{sleep: c.ReconnectSleep, max: c.ReconnectMaxSleep}
+	if b.sleep <= 0 {
+		b.sleep = reconnectSleep
+	}
+
+	if b.max < b.sleep {
+		b.max = b.sleep
+	}
+
+	return b
+}
+
+// next returns the wait before the next attempt.
+func (b *backoff) next() time.Duration {
+	d := b.sleep
+	if b.sleep *= 2; b.sleep > b.max {
+		b.sleep = b.max
+	}
+
+	return d
+}
+
+// dial connects to the broker with the connection settings from c.
+func dial(c Config) (*amqp.Connection, error) {
+	return amqp.DialConfig(c.Dsn, amqpConfig(c))
+}
+
+// amqpConfig returns the connection settings from c, used on every dial and reconnect.
+func amqpConfig(c Config) amqp.Config {
+	locale := c.Locale
+	if locale == "" {
+		locale = defaultLocale
+	}
+
+	heartbeat := c.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = defaultHeartbeat
+	}
+
+	return amqp.Config{
+		Vhost:           c.Vhost,
+		Heartbeat:       heartbeat,
+		Locale:          locale,
+		Properties:      connectionProperties(c),
+		TLSClientConfig: tlsConfig(c),
+	}
+}
+
+// tlsConfig returns the TLS settings from c, nil meaning the amqp defaults.
+func tlsConfig(c Config) *tls.Config {
+	if c.TLSConfig == nil && c.TLSServerName == "" {
+		return nil
+	}
+
+	// every connection gets its own copy, amqp fills the server name in when it is empty.
+	cfg := &tls.Config{}
+	if c.TLSConfig != nil {
+		cfg = c.TLSConfig.Clone()
+	}
+
+	if c.TLSServerName != "" {
+		cfg.ServerName = c.TLSServerName
+	}
+
+	return cfg
+}
+
+// connectionProperties merges the properties from c into the library defaults,
+// a new table is returned on every call as amqp adds the capabilities to it.
+func connectionProperties(c Config) amqp.Table {
+	props := amqp.Table{
+		"product":  "rabbus",
+		"platform": "golang",
+	}
+
+	for k, v := range c.ConnectionProperties {
+		props[k] = v
+	}
+
+	if c.ConnectionName != "" {
+		props["connection_name"] = c.ConnectionName
+	}
+
+	return props
+}
@@ -0,0 +1,159 @@
+package rabbus
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		config Config
+		want   []time.Duration
+	}{
+		{Config{}, []time.Duration{reconnectSleep, reconnectSleep, reconnectSleep}},
+		{Config{ReconnectSleep: time.Second}, []time.Duration{time.Second, time.Second, time.Second}},
+		{
+			Config{ReconnectSleep: time.Second, ReconnectMaxSleep: 5 * time.Second},
+			[]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		b := newBackoff(tt.config)
+		for i, want := range tt.want {
+			if got := b.next(); got != want {
+				t.Errorf("Expected attempt %d to wait %s, got %s", i+1, want, got)
+			}
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	if cfg := tlsConfig(Config{}); cfg != nil {
+		t.Fatalf("Expected the amqp defaults, got %+v", cfg)
+	}
+
+	custom := &tls.Config{InsecureSkipVerify: true}
+	cfg := tlsConfig(Config{TLSConfig: custom, TLSServerName: "rabbitmq.internal"})
+	if cfg == custom || !cfg.InsecureSkipVerify || cfg.ServerName != "rabbitmq.internal" {
+		t.Fatalf("Expected a copy of the custom config with the server name, got %+v", cfg)
+	}
+
+	if custom.ServerName != "" {
+		t.Fatalf("Expected the custom config to be left untouched, got %q", custom.ServerName)
+	}
+}
+
+func TestAMQPConfig(t *testing.T) {
+	cfg := amqpConfig(Config{})
+	if cfg.Vhost != "" || cfg.Locale != defaultLocale || cfg.Heartbeat != defaultHeartbeat || cfg.Properties["connection_name"] != nil {
+		t.Fatalf("Expected the defaults, got %+v", cfg)
+	}
+
+	cfg = amqpConfig(Config{
+		Vhost:                "orders",
+		Heartbeat:            3 * time.Second,
+		Locale:               "pt_BR",
+		ConnectionName:       "orders-api",
+		ConnectionProperties: amqp.Table{"connection_name": "ignored", "version": "1.0"},
+	})
+	if cfg.Vhost != "orders" || cfg.Heartbeat != 3*time.Second || cfg.Locale != "pt_BR" {
+		t.Errorf("Expected the vhost, heartbeat and locale to be set, got %+v", cfg)
+	}
+
+	if cfg.Properties["connection_name"] != "orders-api" || cfg.Properties["version"] != "1.0" || cfg.Properties["product"] != "rabbus" {
+		t.Errorf("Expected the connection name on top of the properties, got %v", cfg.Properties)
+	}
+}
+
+func TestIsConnectedWithoutConnection(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	if r.IsConnected() {
+		t.Fatal("Expected not to be connected without a connection")
+	}
+}
+
+func TestReconnectStopsOnClose(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{ReconnectSleep: time.Hour})
+
+	done := make(chan bool)
+	go func() {
+		done <- r.reconnect()
+	}()
+
+	close(r.closed)
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Expected not to reconnect once closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected to stop reconnecting once closed")
+	}
+}
+
+func TestConnectionLostWithReconnectDisabled(t *testing.T) {
+	var closeErr error
+	r := newTestRabbus(&fakeChannel{}, Config{
+		ReconnectSleep:   time.Hour,
+		DisableReconnect: true,
+		OnClose:          func(err error) { closeErr = err },
+	})
+
+	lost := &amqp.Error{Code: amqp.ConnectionForced, Reason: "closed by the broker"}
+	done := make(chan bool)
+	go func() {
+		done <- r.connectionLost(lost)
+	}()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Expected not to reconnect when disabled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected not to wait for a reconnection when disabled")
+	}
+
+	if closeErr != lost {
+		t.Fatalf("Expected OnClose to be called with the connection error, got %v", closeErr)
+	}
+}
+
+func TestConnectionLostOnceClosed(t *testing.T) {
+	called := false
+	logger := &recordingLogger{}
+	r := newTestRabbus(&fakeChannel{}, Config{
+		ReconnectSleep: time.Hour,
+		Logger:         logger,
+		OnClose:        func(error) { called = true },
+	})
+	close(r.closed)
+
+	if r.connectionLost(&amqp.Error{Code: amqp.ConnectionForced}) {
+		t.Error("Expected not to reconnect once closed")
+	}
+
+	if called {
+		t.Error("Expected OnClose not to be called with reconnect enabled")
+	}
+
+	if len(*logger) != 1 {
+		t.Fatalf("Expected the lost connection to be logged, got %v", *logger)
+	}
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	b := JitteredBackoff(100*time.Millisecond, time.Second)
+
+	for attempt, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 10: time.Second} {
+		for i := 0; i < 100; i++ {
+			if d := b(attempt); d < 0 || d > max {
+				t.Fatalf("Expected a wait up to %s after attempt %d, got %s", max, attempt, d)
+			}
+		}
+	}
+}
@@ -0,0 +1,569 @@
+package rabbus
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// channelSettings carries the settings applied to a channel every time it is opened, producer and
+// consumer channels store their own so each of them is restored independently after a reconnect.
+type channelSettings struct {
+	confirm       bool
+	prefetchCount int
+	prefetchSize  int
+	global        bool
+}
+
+// defaultPrefetchCount bounds the unacknowledged deliveries of consumers without ListenConfig.PrefetchCount.
+const defaultPrefetchCount = 10
+
+// defaultConsumerBufferSize is the buffer of the channels returned by Listen without Config.ConsumerBufferSize.
+const defaultConsumerBufferSize = 256
+
+// messages returns the channel the deliveries of a consumer are forwarded to for Listen and its variants.
+func (r *rabbus) messages() chan ConsumerMessage {
+	size := r.config.ConsumerBufferSize
+	if size <= 0 {
+		size = defaultConsumerBufferSize
+	}
+
+	return make(chan ConsumerMessage, size)
+}
+
+// settings returns the settings of a consumer channel listening with c.
+func (c ListenConfig) settings() channelSettings {
+	count := c.PrefetchCount
+	switch {
+	case count == 0:
+		count = defaultPrefetchCount
+	case count < 0:
+		count = 0
+	}
+
+	// the workers would be waiting for deliveries the broker holds back.
+	if count > 0 && c.Concurrency > count {
+		count = c.Concurrency
+	}
+
+	return channelSettings{prefetchCount: count, prefetchSize: c.PrefetchSize, global: c.GlobalQos}
+}
+
+// armable is the subset of amqp.Channel needed to apply channelSettings.
+type armable interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Confirm(noWait bool) error
+}
+
+// rearm applies s to a newly opened channel.
+func (s channelSettings) rearm(ch armable) error {
+	if s.prefetchCount > 0 || s.prefetchSize > 0 {
+		if err := ch.Qos(s.prefetchCount, s.prefetchSize, s.global); err != nil {
+			return err
+		}
+	}
+
+	if s.confirm {
+		if err := ch.Confirm(false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// consumer carries everything needed to subscribe to a queue again, on its own channel,
+// whenever the connection is recovered.
+type consumer struct {
+	sync.Mutex
+	config   ListenConfig
+	settings channelSettings
+	ch       *amqp.Channel
+	queue    string
+	session  *session
+	// setup binds the declared queue before consuming from it.
+	setup func(ch *amqp.Channel, queue string, c ListenConfig) error
+	// args returns the arguments of each subscription, overriding the ones from config.
+	args func() amqp.Table
+	// handle processes the deliveries of a single subscription, returning only once they stop.
+	handle func(msgs <-chan amqp.Delivery, s *session)
+	// handling counts the subscriptions still being handled.
+	handling sync.WaitGroup
+}
+
+// session tracks a single subscription of a consumer. Deliveries can only be acknowledged on the
+// channel they were received from, so once the subscription ends its deliveries become stale.
+type session struct {
+	stale int32
+	// conn is the connection the subscription was made on.
+	conn *amqp.Connection
+	// codec is the Config.Codec of the rabbus consuming, unmarshaling the messages of its content-type.
+	codec Codec
+	// propagator is the Config.Propagator of the rabbus consuming, extracting the trace context of the messages.
+	propagator Propagator
+	// startSpan is the Config.StartConsumerSpan of the rabbus consuming.
+	startSpan func(ctx context.Context, m ConsumerMessage) context.Context
+	// rabbus is the rabbus consuming, republishing the messages retried with ConsumerMessage.Retry.
+	rabbus *rabbus
+
+	sync.Mutex
+	unacked map[uint64]struct{}
+}
+
+func newSession() *session {
+	return &session{unacked: make(map[uint64]struct{})}
+}
+
+// context returns the context of cm, carrying the trace context extracted by the propagator and the consumer
+// span started by startSpan, nil when neither is set.
+func (s *session) context(cm ConsumerMessage) context.Context {
+	if s == nil || (s.propagator == nil && s.startSpan == nil) {
+		return nil
+	}
+
+	ctx := context.Background()
+	if s.propagator != nil && cm.Headers != nil {
+		ctx = s.propagator.Extract(ctx, HeadersCarrier(cm.Headers))
+	}
+
+	if s.startSpan != nil {
+		ctx = s.startSpan(ctx, cm)
+	}
+
+	return ctx
+}
+
+// delivered records the delivery tag as received but not acknowledged yet.
+func (s *session) delivered(tag uint64) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	s.unacked[tag] = struct{}{}
+	s.Unlock()
+}
+
+// acked forgets the delivery tag, along with all the prior ones when multiple is true.
+func (s *session) acked(tag uint64, multiple bool) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if !multiple {
+		delete(s.unacked, tag)
+		return
+	}
+
+	for t := range s.unacked {
+		if t <= tag {
+			delete(s.unacked, t)
+		}
+	}
+}
+
+// inFlight returns the number of deliveries not acknowledged yet.
+func (s *session) inFlight() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.unacked)
+}
+
+func (s *session) markStale() {
+	atomic.StoreInt32(&s.stale, 1)
+}
+
+func (s *session) isStale() bool {
+	return s != nil && atomic.LoadInt32(&s.stale) == 1
+}
+
+// newSession marks the deliveries of the current subscription as stale and starts a new one.
+func (c *consumer) newSession(ch *amqp.Channel, queue string) *session {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.session != nil {
+		c.session.markStale()
+	}
+
+	c.ch, c.queue, c.session = ch, queue, newSession()
+
+	return c.session
+}
+
+// inFlight returns the number of deliveries of the current subscription not acknowledged yet,
+// the deliveries of previous subscriptions are redelivered by the broker once they are gone.
+func (c *consumer) inFlight() int {
+	c.Lock()
+	s := c.session
+	c.Unlock()
+
+	if s == nil {
+		return 0
+	}
+
+	return s.inFlight()
+}
+
+// current reports whether s is the current subscription of c.
+func (c *consumer) current(s *session) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.session == s
+}
+
+// channel returns the channel of the current subscription.
+func (c *consumer) channel() (*amqp.Channel, string) {
+	c.Lock()
+	defer c.Unlock()
+	return c.ch, c.queue
+}
+
+// consume subscribes c on the current connection and registers it to be subscribed again
+// after every reconnect. Consumers are subscribed concurrently, the read lock held until c is
+// registered keeps the connection from being recovered in between.
+func (r *rabbus) consume(c *consumer) error {
+	r.RLock()
+	defer r.RUnlock()
+
+	if err := r.subscribe(r.conn, c); err != nil {
+		return err
+	}
+
+	r.consumersLock.Lock()
+	r.consumers = append(r.consumers, c)
+	r.consumersLock.Unlock()
+
+	return nil
+}
+
+// cancel unregisters c, so it is not subscribed again, and closes its channel, returning the error
+// cancelling its consumer tag. It does not wait for the deliveries being handled, see handled, so
+// a handler may cancel its own consumer. The write lock keeps c from being subscribed meanwhile by a recovery.
+func (r *rabbus) cancel(c *consumer) (err error) {
+	r.Lock()
+	r.consumersLock.Lock()
+	for i, cons := range r.consumers {
+		if cons == c {
+			r.consumers = append(r.consumers[:i], r.consumers[i+1:]...)
+			break
+		}
+	}
+	r.consumersLock.Unlock()
+
+	if ch, _ := c.channel(); ch != nil {
+		if tag := c.config.ConsumerTag; tag != "" {
+			// the broker stops delivering before the channel is closed.
+			err = ch.Cancel(tag, false)
+		}
+		ch.Close()
+	}
+	r.Unlock()
+
+	return err
+}
+
+// handled returns a channel closed once the deliveries of c being handled are done, after cancel.
+func (c *consumer) handled() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		c.handling.Wait()
+		close(done)
+	}()
+
+	return done
+}
+
+// resubscribe subscribes c again once its subscription s stopped while the connection is still open,
+// e.g. the broker closed the channel on an error or cancelled the consumer as the queue was deleted.
+// Subscriptions replaced by a reconnect or by Recover, and cancelled consumers, are left alone.
+// Failed attempts are retried with the reconnect backoff until rabbus is closed.
+func (r *rabbus) resubscribe(c *consumer, s *session) {
+	r.retryBackoff(func() bool {
+		r.RLock()
+		defer r.RUnlock()
+
+		// a subscription of a previous connection is recovered by the reconnect.
+		if r.conn.IsClosed() || s.conn != r.conn || !r.registered(c) || !c.current(s) {
+			return true
+		}
+
+		if err := r.subscribe(r.conn, c); err != nil {
+			r.config.logf("rabbus: consumer of queue %s failed to recover: %s", c.config.Queue, err)
+			return false
+		}
+
+		return true
+	})
+}
+
+// recoverConsumer subscribes c on conn, the connection rabbus reconnected with, unless c was cancelled
+// or conn was replaced meanwhile. A consumer failing to recover stays idle until the next reconnect.
+func (r *rabbus) recoverConsumer(conn *amqp.Connection, c *consumer) {
+	r.RLock()
+	defer r.RUnlock()
+
+	if r.conn != conn || !r.registered(c) {
+		return
+	}
+
+	if err := r.subscribe(conn, c); err != nil {
+		r.config.logf("rabbus: consumer of queue %s failed to recover: %s", c.config.Queue, err)
+	}
+}
+
+// retryBackoff calls attempt until it is done, waiting for the reconnect backoff after each failure
+// and giving up once rabbus is closed.
+func (r *rabbus) retryBackoff(attempt func() (done bool)) {
+	b := newBackoff(r.config)
+	for !attempt() {
+		select {
+		case <-time.After(b.next()):
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// registered reports whether c is subscribed again after every reconnect.
+func (r *rabbus) registered(c *consumer) bool {
+	r.consumersLock.Lock()
+	defer r.consumersLock.Unlock()
+
+	for _, cons := range r.consumers {
+		if cons == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// subscribe opens a channel for c on conn, restores its settings, declares and binds its queue
+// and starts handling the deliveries.
+// Transient failures are retried on a new channel, as the broker closes channels on errors.
+func (r *rabbus) subscribe(conn *amqp.Connection, c *consumer) error {
+	var (
+		ch    *amqp.Channel
+		msgs  <-chan amqp.Delivery
+		queue string
+	)
+
+	err := r.retryTransient(func() error {
+		var err error
+		if ch, err = conn.Channel(); err != nil {
+			return err
+		}
+
+		msgs, queue, err = r.setupConsumer(ch, c)
+		if err == ErrQueueMismatch && c.config.RecreateQueue {
+			// the broker closed the channel when refusing the declaration.
+			ch.Close()
+			if ch, err = conn.Channel(); err != nil {
+				return err
+			}
+			if err = r.deleteQueue(ch, c.config.Queue); err != nil {
+				return err
+			}
+
+			if ch, err = conn.Channel(); err != nil {
+				return err
+			}
+			msgs, queue, err = r.setupConsumer(ch, c)
+		}
+
+		if err != nil {
+			ch.Close()
+		}
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s := c.newSession(ch, queue)
+	s.conn, s.codec, s.propagator, s.startSpan, s.rabbus = conn, r.config.Codec, r.config.Propagator, r.config.StartConsumerSpan, r
+	c.handling.Add(1)
+	go func() {
+		defer c.handling.Done()
+		c.handle(msgs, s)
+		s.markStale()
+		r.resubscribe(c, s)
+	}()
+
+	return nil
+}
+
+// setupConsumer prepares the new channel ch for c and starts consuming from it. The settings are restored
+// before consuming, the broker would otherwise deliver more than the prefetch to a recovered subscription,
+// and nothing else uses ch meanwhile since consumers never share their channel.
+func (r *rabbus) setupConsumer(ch *amqp.Channel, c *consumer) (<-chan amqp.Delivery, string, error) {
+	if err := c.settings.rearm(ch); err != nil {
+		return nil, "", err
+	}
+
+	queue := c.config.Queue
+	if !c.config.SkipDeclare {
+		var err error
+		if queue, err = r.declareQueue(ch, c.config); err != nil {
+			return nil, "", err
+		}
+
+		if c.setup != nil {
+			if err := c.setup(ch, queue, c.config); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	args := c.config.consumeArgs()
+	if c.args != nil {
+		args = c.args()
+	}
+
+	msgs, err := ch.Consume(queue, c.config.ConsumerTag, false, false, c.config.NoLocal, c.config.NoWait, args)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return msgs, queue, nil
+}
+
+// durable returns the durability override when set, otherwise Config.Durable.
+func (r *rabbus) durable(override *bool) bool {
+	if override != nil {
+		return *override
+	}
+
+	return r.config.Durable
+}
+
+// name applies the configured prefix to an exchange or queue name.
+func (r *rabbus) name(n string) string {
+	if n == "" || r.config.NamePrefix == "" || strings.HasPrefix(n, "amq.") {
+		return n
+	}
+
+	return r.config.NamePrefix + n
+}
+
+// prefixed returns c with the configured prefix applied to all exchange and queue names.
+func (r *rabbus) prefixed(c ListenConfig) ListenConfig {
+	c.Exchange = r.name(c.Exchange)
+	c.Queue = r.name(c.Queue)
+
+	bindings := make([]Binding, len(c.Bindings))
+	for i, b := range c.Bindings {
+		b.Exchange = r.name(b.Exchange)
+		bindings[i] = b
+	}
+	c.Bindings = bindings
+
+	return c
+}
+
+// validateListenConfig checks c, reporting every problem found at once.
+func validateListenConfig(c ListenConfig) error {
+	var v validation
+	for _, b := range c.bindings() {
+		v.check(b.Exchange == "", ErrMissingExchange)
+		v.check(b.Kind == "", ErrMissingKind)
+	}
+	// the broker names the exclusive queues declared without a name, the retry queues are named after the queue.
+	v.check(c.Queue == "" && (!c.Exclusive || c.NoWait || c.Passive || c.SkipDeclare || len(c.RetryDelays) > 0), ErrMissingQueue)
+	// amqp refuses the declaration anyway, checking the arguments first saves the retries.
+	if err := c.QueueArgs.Validate(); err != nil {
+		v.check(true, err)
+	}
+
+	return v.err()
+}
+
+// consumeArgs returns the consumer arguments from c.
+func (c ListenConfig) consumeArgs() amqp.Table {
+	if c.StreamOffset == nil {
+		return nil
+	}
+
+	return amqp.Table{"x-stream-offset": c.StreamOffset}
+}
+
+// bindings returns every exchange the queue from c is bound to.
+func (c ListenConfig) bindings() []Binding {
+	if c.Exchange == "" && len(c.Bindings) > 0 {
+		return c.Bindings
+	}
+
+	return append([]Binding{{Exchange: c.Exchange, Kind: c.Kind, Key: c.Key}}, c.Bindings...)
+}
+
+func (r *rabbus) declareQueue(ch *amqp.Channel, c ListenConfig) (string, error) {
+	declareExchange, declareQueue := ch.ExchangeDeclare, ch.QueueDeclare
+	if c.Passive {
+		declareExchange, declareQueue = ch.ExchangeDeclarePassive, ch.QueueDeclarePassive
+	}
+
+	declared := make(map[string]struct{})
+	for _, b := range c.bindings() {
+		if _, ok := declared[b.Exchange]; ok {
+			continue
+		}
+
+		if err := declareExchange(b.Exchange, b.Kind, r.durable(c.ExchangeDurable), r.config.ExchangeAutoDelete, c.ExchangeInternal, false, exchangeArgs(b.Kind)); err != nil {
+			return "", err
+		}
+		declared[b.Exchange] = struct{}{}
+	}
+
+	if err := r.declareRetryQueues(declareQueue, c); err != nil {
+		return "", err
+	}
+
+	q, err := declareQueue(c.Queue, r.durable(c.QueueDurable), c.AutoDelete, c.Exclusive, c.NoWait, c.queueArgs())
+	if e, ok := err.(*amqp.Error); ok && e.Code == amqp.PreconditionFailed {
+		return "", ErrQueueMismatch
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return q.Name, nil
+}
+
+// queueDeleter is the part of amqp.Channel deleting queues.
+type queueDeleter interface {
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+	Close() error
+}
+
+// deleteQueue deletes the queue along with its messages on ch, which is closed afterwards,
+// warning about the messages lost before the queue is declared again.
+func (r *rabbus) deleteQueue(ch queueDeleter, queue string) error {
+	defer ch.Close()
+
+	n, err := ch.QueueDelete(queue, false, false, false)
+	if err != nil {
+		return err
+	}
+
+	r.config.logf("rabbus: warning, queue %s deleted with %d messages to be declared again with different arguments", queue, n)
+	return nil
+}
+
+func bindQueue(ch *amqp.Channel, queue string, c ListenConfig) error {
+	for _, b := range c.bindings() {
+		if err := ch.QueueBind(queue, b.Key, b.Exchange, false, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package rabbus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ConsumeBatch consumes messages in batches of up to maxSize deliveries, handing them to handler
+// together once the batch is full or maxWait elapsed since its first delivery. A zero maxWait waits
+// until the batch is full.
+// When handler returns nil the whole batch is acked at once, otherwise it is nacked and requeued.
+// The consumer runs on its own channel with a prefetch of maxSize, overriding c.PrefetchCount,
+// so acknowledging multiple deliveries never settles messages of other consumers.
+// Stopping the returned Listener requeues the partial batch before cancelling the consumer, along with
+// the deliveries received meanwhile, a batch being handled then is redelivered unless acked before the
+// channel is closed. If the deliveries stop while a batch is partially
+// filled, e.g. the connection was closed, the partial batch is discarded without calling handler:
+// it can not be acknowledged anymore and the broker will redeliver it. Failures acknowledging a batch,
+// like ErrStaleDelivery, are logged.
+func (r *rabbus) ConsumeBatch(c ListenConfig, maxSize int, maxWait time.Duration, handler func([]ConsumerMessage) error) (*Listener, error) {
+	if err := validateListenConfig(c); err != nil {
+		return nil, err
+	}
+
+	if handler == nil {
+		return nil, ErrMissingHandler
+	}
+
+	if maxSize < 1 {
+		return nil, ErrInvalidBatchSize
+	}
+
+	settings := c.settings()
+	settings.prefetchCount = maxSize
+
+	c = r.prefixed(c)
+	b := r.newBatcher(c.Queue, maxSize, handler)
+	cons := &consumer{
+		config:   c,
+		settings: settings,
+		setup:    bindQueue,
+		handle: func(msgs <-chan amqp.Delivery, s *session) {
+			r.consumeBatch(msgs, s, b, maxWait)
+		},
+	}
+
+	if err := r.consume(cons); err != nil {
+		return nil, err
+	}
+
+	return r.listener(cons, func() (<-chan struct{}, error) {
+		b.stop()
+		err := r.cancel(cons)
+		return cons.handled(), err
+	}), nil
+}
+
+// batcher collects the deliveries of a batch consumer, the batches are handed to handler by the consumer
+// goroutine only, without holding the lock so the handler may stop the consumer.
+type batcher struct {
+	sync.Mutex
+	rabbus  *rabbus
+	queue   string
+	maxSize int
+	handler func([]ConsumerMessage) error
+	batch   []ConsumerMessage
+	stopped bool
+}
+
+func (r *rabbus) newBatcher(queue string, maxSize int, handler func([]ConsumerMessage) error) *batcher {
+	return &batcher{rabbus: r, queue: queue, maxSize: maxSize, handler: handler, batch: make([]ConsumerMessage, 0, maxSize)}
+}
+
+// add adds m to the batch, handing the batch to handler once full, and reports whether m started
+// a new batch. Once stopped m is requeued instead.
+func (b *batcher) add(m ConsumerMessage) bool {
+	b.Lock()
+	if b.stopped {
+		b.Unlock()
+		b.requeue(m)
+		return false
+	}
+
+	b.batch = append(b.batch, m)
+	if len(b.batch) < b.maxSize {
+		started := len(b.batch) == 1
+		b.Unlock()
+		return started
+	}
+
+	batch := b.take()
+	b.Unlock()
+	b.handle(batch)
+
+	return false
+}
+
+// expire hands the partial batch to handler once maxWait elapsed since its first delivery.
+func (b *batcher) expire() {
+	b.Lock()
+	batch := b.take()
+	b.Unlock()
+	b.handle(batch)
+}
+
+// stop requeues the partial batch, along with the deliveries received afterwards.
+func (b *batcher) stop() {
+	b.Lock()
+	batch := b.take()
+	b.stopped = true
+	b.Unlock()
+
+	// one at a time, nacking multiple deliveries would settle a batch being handled too.
+	for _, m := range batch {
+		b.requeue(m)
+	}
+}
+
+// discard drops the partial batch of a subscription whose deliveries stopped.
+func (b *batcher) discard() {
+	b.Lock()
+	defer b.Unlock()
+	b.take()
+}
+
+// take returns the partial batch and starts a new one.
+func (b *batcher) take() []ConsumerMessage {
+	batch := b.batch
+	b.batch = make([]ConsumerMessage, 0, b.maxSize)
+	return batch
+}
+
+func (b *batcher) requeue(m ConsumerMessage) {
+	if err := m.Nack(false, true); err != nil {
+		b.rabbus.config.logf("rabbus: message of queue %s failed to be requeued: %s", b.queue, err)
+	}
+}
+
+func (b *batcher) handle(batch []ConsumerMessage) {
+	if len(batch) == 0 {
+		return
+	}
+
+	last := batch[len(batch)-1]
+	err := b.handler(batch)
+	if err != nil {
+		err = last.Nack(true, true)
+	} else {
+		err = last.Ack(true)
+	}
+
+	if err != nil {
+		b.rabbus.config.logf("rabbus: batch of %d messages of queue %s failed to be acknowledged: %s", len(batch), b.queue, err)
+	}
+}
+
+func (r *rabbus) consumeBatch(msgs <-chan amqp.Delivery, s *session, b *batcher, maxWait time.Duration) {
+	var (
+		timer   *time.Timer
+		timeout <-chan time.Time
+	)
+
+	stopTimer := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, timeout = nil, nil
+		}
+	}
+	defer stopTimer()
+
+	for {
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				b.discard()
+				return
+			}
+
+			if b.add(newConsumerMessage(d, s)) && maxWait > 0 {
+				stopTimer()
+				timer = time.NewTimer(maxWait)
+				timeout = timer.C
+			}
+		case <-timeout:
+			timer, timeout = nil, nil
+			b.expire()
+		}
+	}
+}
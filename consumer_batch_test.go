@@ -0,0 +1,180 @@
+package rabbus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConsumeBatchFlushesFullBatch(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	ack := &acknowledger{}
+	msgs := make(chan amqp.Delivery, 4)
+	for tag := uint64(1); tag <= 4; tag++ {
+		msgs <- amqp.Delivery{Acknowledger: ack, DeliveryTag: tag}
+	}
+	close(msgs)
+
+	var sizes []int
+	r.rabbus.consumeBatch(msgs, newSession(), r.newBatcher("test_queue", 2, func(batch []ConsumerMessage) error {
+		sizes = append(sizes, len(batch))
+		return nil
+	}), 0)
+
+	if len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 2 {
+		t.Fatalf("Expected two batches of 2 messages, got %v", sizes)
+	}
+
+	if ack.acks != 2 || ack.last != "ack" || ack.tag != 4 || !ack.multiple {
+		t.Fatalf("Expected each batch acked at once up to its last delivery, got %+v", ack)
+	}
+}
+
+func TestConsumeBatchFlushesOnMaxWait(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	ack := &acknowledger{}
+	msgs := make(chan amqp.Delivery, 1)
+	msgs <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+
+	handled := make(chan int, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.rabbus.consumeBatch(msgs, newSession(), r.newBatcher("test_queue", 10, func(batch []ConsumerMessage) error {
+			handled <- len(batch)
+			return nil
+		}), 10*time.Millisecond)
+	}()
+
+	select {
+	case n := <-handled:
+		if n != 1 {
+			t.Fatalf("Expected the partial batch of 1 message, got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the partial batch to be flushed once maxWait elapsed")
+	}
+
+	close(msgs)
+	<-done
+
+	if ack.last != "ack" || ack.tag != 1 {
+		t.Fatalf("Expected the partial batch to be acked, got %+v", ack)
+	}
+}
+
+func TestConsumeBatchNacksOnHandlerError(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	ack := &acknowledger{}
+	msgs := make(chan amqp.Delivery, 3)
+	for tag := uint64(1); tag <= 3; tag++ {
+		msgs <- amqp.Delivery{Acknowledger: ack, DeliveryTag: tag}
+	}
+	close(msgs)
+
+	r.rabbus.consumeBatch(msgs, newSession(), r.newBatcher("test_queue", 3, func([]ConsumerMessage) error {
+		return errors.New("failed")
+	}), 0)
+
+	if ack.acks != 1 || ack.last != "requeue" || ack.tag != 3 || !ack.multiple {
+		t.Fatalf("Expected the whole batch nacked and requeued at once, got %+v", ack)
+	}
+}
+
+func TestConsumeBatchDiscardsPartialBatch(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	ack := &acknowledger{}
+	msgs := make(chan amqp.Delivery, 2)
+	msgs <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+	msgs <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 2}
+	close(msgs)
+
+	called := false
+	r.rabbus.consumeBatch(msgs, newSession(), r.newBatcher("test_queue", 3, func([]ConsumerMessage) error {
+		called = true
+		return nil
+	}), time.Hour)
+
+	if called {
+		t.Fatal("Expected the partial batch to be discarded once the deliveries stopped")
+	}
+
+	if ack.acks != 0 {
+		t.Fatalf("Expected the partial batch not to be acknowledged, got %+v", ack)
+	}
+}
+
+func TestConsumeBatchLogsStaleDelivery(t *testing.T) {
+	logger := &recordingLogger{}
+	r := newTestRabbus(&fakeChannel{}, Config{Logger: logger})
+	ack := &acknowledger{}
+	s := newSession()
+	msgs := make(chan amqp.Delivery, 1)
+	msgs <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+	close(msgs)
+
+	r.rabbus.consumeBatch(msgs, s, r.newBatcher("test_queue", 1, func([]ConsumerMessage) error {
+		s.markStale()
+		return nil
+	}), 0)
+
+	if ack.acks != 0 {
+		t.Fatalf("Expected the stale batch not to be acknowledged, got %+v", ack)
+	}
+
+	if len(*logger) != 1 {
+		t.Fatalf("Expected the failed acknowledgement to be logged, got %v", *logger)
+	}
+}
+
+func TestConsumeBatchStopRequeuesPartialBatch(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	ack := &acknowledger{}
+	s := newSession()
+	called := false
+	b := r.newBatcher("test_queue", 3, func(batch []ConsumerMessage) error {
+		called = true
+		return nil
+	})
+
+	b.add(newConsumerMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}, s))
+	b.add(newConsumerMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: 2}, s))
+	b.stop()
+
+	if called || ack.acks != 2 || ack.last != "requeue" || ack.tag != 2 || ack.multiple {
+		t.Fatalf("Expected the partial batch requeued one at a time on stop, got %+v", ack)
+	}
+
+	b.add(newConsumerMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: 3}, s))
+	if called || ack.acks != 3 || ack.last != "requeue" || ack.tag != 3 {
+		t.Fatalf("Expected the delivery received once stopped to be requeued, got %+v", ack)
+	}
+}
+
+func TestConsumeBatchHandlerStops(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	ack := &acknowledger{}
+	var b *batcher
+	b = r.newBatcher("test_queue", 1, func([]ConsumerMessage) error {
+		b.stop()
+		return nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.add(newConsumerMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}, newSession()))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the handler to stop the batch consumer")
+	}
+
+	if ack.last != "ack" || ack.tag != 1 {
+		t.Fatalf("Expected the batch handled when stopping to be acked, got %+v", ack)
+	}
+}
@@ -1,6 +1,7 @@
 package rabbus
 
 import (
+	"context"
 	"time"
 
 	"github.com/streadway/amqp"
@@ -9,12 +10,18 @@ import (
 // ConsumerMessage captures the fields for a previously delivered message resident in a queue
 // to be delivered by the server to a consumer.
 type ConsumerMessage struct {
-	delivery        amqp.Delivery
-	ContentType     string
+	delivery amqp.Delivery
+	session  *session
+	// ctx is returned by Context, nil unless a Propagator or a StartConsumerSpan hook is set.
+	ctx context.Context
+	// Headers application or exchange specific fields
+	Headers     amqp.Table
+	ContentType string
+	// ContentEncoding the message content-encoding as published, empty when none was set.
 	ContentEncoding string
 	// DeliveryMode queue implementation use, non-persistent (1) or persistent (2)
 	DeliveryMode uint8
-	// Priority queue implementation use, 0 to 9
+	// Priority the message priority on priority queues, see ListenConfig.MaxPriority
 	Priority uint8
 	// CorrelationId application use, correlation identifier
 	CorrelationId string
@@ -40,9 +47,13 @@ type ConsumerMessage struct {
 	Body []byte
 }
 
-func newConsumerMessage(m amqp.Delivery) ConsumerMessage {
-	return ConsumerMessage{
+func newConsumerMessage(m amqp.Delivery, s *session) ConsumerMessage {
+	s.delivered(m.DeliveryTag)
+
+	cm := ConsumerMessage{
 		delivery:        m,
+		session:         s,
+		Headers:         m.Headers,
 		ContentType:     m.ContentType,
 		ContentEncoding: m.ContentEncoding,
 		DeliveryMode:    m.DeliveryMode,
@@ -50,6 +61,7 @@ func newConsumerMessage(m amqp.Delivery) ConsumerMessage {
 		CorrelationId:   m.CorrelationId,
 		ReplyTo:         m.ReplyTo,
 		Expiration:      m.Expiration,
+		MessageId:       m.MessageId,
 		Timestamp:       m.Timestamp,
 		Type:            m.Type,
 		ConsumerTag:     m.ConsumerTag,
@@ -60,6 +72,119 @@ func newConsumerMessage(m amqp.Delivery) ConsumerMessage {
 		Key:             m.RoutingKey,
 		Body:            m.Body,
 	}
+	cm.ctx = s.context(cm)
+
+	return cm
+}
+
+// NewConsumerMessage returns a ConsumerMessage as if m was delivered to a consumer, e.g. to test handlers.
+// The message can not be acknowledged.
+func NewConsumerMessage(m Message) ConsumerMessage {
+	return newConsumerMessage(amqp.Delivery{
+		Exchange:        m.Exchange,
+		RoutingKey:      m.Key,
+		Headers:         m.Headers,
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		DeliveryMode:    m.DeliveryMode,
+		CorrelationId:   m.CorrelationId,
+		ReplyTo:         m.ReplyTo,
+		Expiration:      m.Expiration,
+		Priority:        m.Priority,
+		MessageId:       m.MessageId,
+		Timestamp:       m.Timestamp,
+		Body:            m.Payload,
+	}, nil)
+}
+
+// ToMessage returns a Message carrying the body and properties of the message, to publish it again
+// as it was received. The exchange kind is not known from a delivery and is left empty.
+func (cm *ConsumerMessage) ToMessage() Message {
+	return Message{
+		Exchange:        cm.Exchange,
+		Key:             cm.Key,
+		Payload:         cm.Body,
+		Headers:         cm.Headers,
+		DeliveryMode:    cm.DeliveryMode,
+		ContentType:     cm.ContentType,
+		ContentEncoding: cm.ContentEncoding,
+		CorrelationId:   cm.CorrelationId,
+		ReplyTo:         cm.ReplyTo,
+		Expiration:      cm.Expiration,
+		Priority:        cm.Priority,
+		MessageId:       cm.MessageId,
+		Timestamp:       cm.Timestamp,
+	}
+}
+
+// publishing returns an amqp.Publishing carrying the body and properties of the message.
+func (cm *ConsumerMessage) publishing() amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         cm.Headers,
+		ContentType:     cm.ContentType,
+		ContentEncoding: cm.ContentEncoding,
+		DeliveryMode:    cm.DeliveryMode,
+		Priority:        cm.Priority,
+		CorrelationId:   cm.CorrelationId,
+		ReplyTo:         cm.ReplyTo,
+		Expiration:      cm.Expiration,
+		MessageId:       cm.MessageId,
+		Timestamp:       cm.Timestamp,
+		Type:            cm.Type,
+		AppId:           cm.delivery.AppId,
+		Body:            cm.Body,
+	}
+}
+
+// Unmarshal parses the message body with the codec for its content-type, Config.Codec or else the
+// registered one, storing the result in the value pointed to by v, so consumers share the serialization
+// of the producers. Gzipped bodies are decompressed first. Returns ErrUnknownContentType when there is no codec.
+func (cm *ConsumerMessage) Unmarshal(v interface{}) error {
+	c, err := cm.codec()
+	if err != nil {
+		return err
+	}
+
+	body, err := cm.body()
+	if err != nil {
+		return err
+	}
+
+	return c.Unmarshal(body, v)
+}
+
+// Decode parses the message body into the value pointed to by v with the codec for its content-type,
+// like Unmarshal, decoding the values emitted by EmitValue. JSON is assumed without content-type.
+// Returns ErrUnknownContentType when there is no codec.
+func (cm *ConsumerMessage) Decode(v interface{}) error {
+	return cm.Unmarshal(v)
+}
+
+// codec returns the codec unmarshaling the message body.
+func (cm *ConsumerMessage) codec() (Codec, error) {
+	if s := cm.session; s != nil && s.codec != nil && cm.ContentType == s.codec.ContentType() {
+		return s.codec, nil
+	}
+
+	return codecFor(cm.ContentType)
+}
+
+// Context returns a context carrying the trace context extracted from the message headers by
+// Config.Propagator, along with the consumer span started by Config.StartConsumerSpan when it is set,
+// once for each delivery. The handler ends that span. Without a Propagator nor StartConsumerSpan
+// it returns an empty context.
+func (cm *ConsumerMessage) Context() context.Context {
+	if cm.ctx == nil {
+		return context.Background()
+	}
+
+	return cm.ctx
+}
+
+// Stale reports whether the channel the message was received from is gone, e.g. after a reconnect.
+// Stale messages can not be acknowledged anymore, the broker redelivers them.
+func (cm *ConsumerMessage) Stale() bool {
+	return cm.session.isStale()
 }
 
 // Ack delegates an acknowledgement through the Acknowledger interface that the client or server has finished work on a delivery.
@@ -67,8 +192,19 @@ func newConsumerMessage(m amqp.Delivery) ConsumerMessage {
 // When multiple is true, this delivery and all prior unacknowledged deliveries on the same channel will be acknowledged. This is useful for batch processing of deliveries.
 // An error will indicate that the acknowledge could not be delivered to the channel it was sent from.
 // Either Delivery.Ack, Delivery.Reject or Delivery.Nack must be called for every delivery that is not automatically acknowledged.
+// ErrStaleDelivery is returned when the channel the message was received from is gone.
 func (cm *ConsumerMessage) Ack(multiple bool) error {
-	return cm.delivery.Ack(multiple)
+	if cm.Stale() {
+		return ErrStaleDelivery
+	}
+
+	if err := cm.delivery.Ack(multiple); err != nil {
+		return err
+	}
+
+	cm.session.acked(cm.DeliveryTag, multiple)
+
+	return nil
 }
 
 // Nack negatively acknowledge the delivery of message(s) identified by the delivery tag from either the client or server.
@@ -77,7 +213,17 @@ func (cm *ConsumerMessage) Ack(multiple bool) error {
 // This method must not be used to select or requeue messages the client wishes not to handle, rather it is to inform the server that the client is incapable of handling this message at this time.
 // Either Delivery.Ack, Delivery.Reject or Delivery.Nack must be called for every delivery that is not automatically acknowledged.
 func (cm *ConsumerMessage) Nack(multiple, requeue bool) error {
-	return cm.delivery.Nack(multiple, requeue)
+	if cm.Stale() {
+		return ErrStaleDelivery
+	}
+
+	if err := cm.delivery.Nack(multiple, requeue); err != nil {
+		return err
+	}
+
+	cm.session.acked(cm.DeliveryTag, multiple)
+
+	return nil
 }
 
 // Reject delegates a negatively acknowledgement through the Acknowledger interface.
@@ -85,5 +231,15 @@ func (cm *ConsumerMessage) Nack(multiple, requeue bool) error {
 // If you are batch processing deliveries, and your server supports it, prefer Delivery.Nack.
 // Either Delivery.Ack, Delivery.Reject or Delivery.Nack must be called for every delivery that is not automatically acknowledged.
 func (cm *ConsumerMessage) Reject(requeue bool) error {
-	return cm.delivery.Reject(requeue)
+	if cm.Stale() {
+		return ErrStaleDelivery
+	}
+
+	if err := cm.delivery.Reject(requeue); err != nil {
+		return err
+	}
+
+	cm.session.acked(cm.DeliveryTag, false)
+
+	return nil
 }
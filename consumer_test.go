@@ -0,0 +1,424 @@
+package rabbus
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+type armableChannel struct {
+	qos     []int
+	global  bool
+	confirm bool
+}
+
+func (ch *armableChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	ch.qos = []int{prefetchCount, prefetchSize}
+	ch.global = global
+	return nil
+}
+
+func (ch *armableChannel) Confirm(noWait bool) error {
+	ch.confirm = true
+	return nil
+}
+
+func TestChannelSettingsRearm(t *testing.T) {
+	producer := &armableChannel{}
+	if err := (channelSettings{confirm: true}).rearm(producer); err != nil {
+		t.Fatalf("Expected to rearm producer channel %s", err)
+	}
+
+	if !producer.confirm || producer.qos != nil {
+		t.Errorf("Expected producer channel to be put in confirm mode only, got %+v", producer)
+	}
+
+	consumer := &armableChannel{}
+	if err := (channelSettings{prefetchCount: 10, global: true}).rearm(consumer); err != nil {
+		t.Fatalf("Expected to rearm consumer channel %s", err)
+	}
+
+	if consumer.confirm || consumer.qos[0] != 10 || !consumer.global {
+		t.Errorf("Expected consumer channel qos to be restored only, got %+v", consumer)
+	}
+}
+
+func TestListenConfigSettings(t *testing.T) {
+	tests := []struct {
+		prefetch, concurrency, want int
+	}{
+		{0, 0, defaultPrefetchCount},
+		{50, 0, 50},
+		{-1, 0, 0},
+		{5, 20, 20},
+		{-1, 20, 0},
+	}
+
+	for _, tt := range tests {
+		s := ListenConfig{PrefetchCount: tt.prefetch, PrefetchSize: 1024, Concurrency: tt.concurrency}.settings()
+		if s.prefetchCount != tt.want || s.prefetchSize != 1024 {
+			t.Errorf("Expected prefetch %d for %d with concurrency %d, got %+v", tt.want, tt.prefetch, tt.concurrency, s)
+		}
+	}
+}
+
+type acknowledger struct {
+	acks     int
+	last     string
+	tag      uint64
+	multiple bool
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks++
+	a.last = "ack"
+	a.tag = tag
+	a.multiple = multiple
+	return nil
+}
+
+func (a *acknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.acks++
+	a.last = "nack"
+	a.tag = tag
+	a.multiple = multiple
+	if requeue {
+		a.last = "requeue"
+	}
+	return nil
+}
+
+func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	a.acks++
+	a.last = "reject"
+	a.tag = tag
+	return nil
+}
+
+func TestConsumerBufferSize(t *testing.T) {
+	for _, tt := range []struct {
+		size, want int
+	}{
+		{0, defaultConsumerBufferSize},
+		{-1, defaultConsumerBufferSize},
+		{1024, 1024},
+	} {
+		r := &rabbus{config: Config{ConsumerBufferSize: tt.size}}
+		if n := cap(r.messages()); n != tt.want {
+			t.Errorf("Expected a buffer of %d for %d, got %d", tt.want, tt.size, n)
+		}
+	}
+}
+
+func TestConsumerMessageSettlesDelivery(t *testing.T) {
+	ack := &acknowledger{}
+	msgs := make(chan ConsumerMessage, 3)
+	for tag := uint64(1); tag <= 3; tag++ {
+		msgs <- newConsumerMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: tag}, nil)
+	}
+
+	settle := []func(m ConsumerMessage) error{
+		func(m ConsumerMessage) error { return m.Ack(false) },
+		func(m ConsumerMessage) error { return m.Nack(false, true) },
+		func(m ConsumerMessage) error { return m.Reject(false) },
+	}
+
+	for i, want := range []string{"ack", "requeue", "reject"} {
+		m := <-msgs
+		if err := settle[i](m); err != nil {
+			t.Fatalf("Expected to %s message, got %s", want, err)
+		}
+
+		if ack.last != want || ack.tag != m.DeliveryTag {
+			t.Errorf("Expected %s of delivery %d, got %s of %d", want, m.DeliveryTag, ack.last, ack.tag)
+		}
+	}
+}
+
+func TestConsumerMessageStaleAfterReconnect(t *testing.T) {
+	c := &consumer{}
+	ack := &acknowledger{}
+
+	s := c.newSession(nil, "test_q")
+	processing := newConsumerMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}, s)
+	done := newConsumerMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: 2}, s)
+
+	if err := done.Ack(false); err != nil {
+		t.Fatalf("Expected to ack message %s", err)
+	}
+
+	// the connection is recovered while the first message is still being processed.
+	recovered := c.newSession(nil, "test_q")
+
+	if !processing.Stale() {
+		t.Errorf("Expected message from the previous channel to be stale")
+	}
+
+	if err := processing.Ack(false); err != ErrStaleDelivery {
+		t.Errorf("Expected ack to fail with ErrStaleDelivery, got %v", err)
+	}
+
+	if err := processing.Nack(false, true); err != ErrStaleDelivery {
+		t.Errorf("Expected nack to fail with ErrStaleDelivery, got %v", err)
+	}
+
+	if ack.acks != 1 {
+		t.Errorf("Expected stale message not to reach the channel, got %d acks", ack.acks)
+	}
+
+	m := newConsumerMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}, recovered)
+	if err := m.Ack(false); err != nil || m.Stale() {
+		t.Errorf("Expected message from the recovered channel to be acked, got %v", err)
+	}
+}
+
+func TestConsumerInFlight(t *testing.T) {
+	c := &consumer{}
+	ack := &acknowledger{}
+
+	s := c.newSession(nil, "test_q")
+	var msgs []ConsumerMessage
+	for tag := uint64(1); tag <= 4; tag++ {
+		msgs = append(msgs, newConsumerMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: tag}, s))
+	}
+
+	if n := c.inFlight(); n != 4 {
+		t.Fatalf("Expected 4 messages in flight, got %d", n)
+	}
+
+	msgs[3].Reject(false)
+	msgs[1].Ack(true)
+
+	if n := c.inFlight(); n != 1 {
+		t.Fatalf("Expected 1 message in flight, got %d", n)
+	}
+
+	c.newSession(nil, "test_q")
+
+	if n := c.inFlight(); n != 0 {
+		t.Fatalf("Expected no messages in flight after reconnect, got %d", n)
+	}
+}
+
+func TestConsumerMessageToMessage(t *testing.T) {
+	m := Message{
+		Exchange:        "test_ex",
+		Key:             "test_key",
+		Payload:         []byte(`foo`),
+		DeliveryMode:    Persistent,
+		ContentType:     ContentTypePlain,
+		ContentEncoding: "utf-8",
+		CorrelationId:   "42",
+		ReplyTo:         "test_reply_q",
+		Priority:        5,
+		MessageId:       "order-1",
+		Timestamp:       time.Date(2017, 6, 24, 12, 0, 0, 0, time.UTC),
+	}
+
+	cm := NewConsumerMessage(m)
+	got := cm.ToMessage()
+	if got.Exchange != m.Exchange || got.Key != m.Key || string(got.Payload) != string(m.Payload) ||
+		got.DeliveryMode != m.DeliveryMode || got.ContentType != m.ContentType || got.ContentEncoding != m.ContentEncoding ||
+		got.CorrelationId != m.CorrelationId || got.ReplyTo != m.ReplyTo || got.Priority != m.Priority ||
+		got.MessageId != m.MessageId || !got.Timestamp.Equal(m.Timestamp) {
+		t.Fatalf("Expected %+v, got %+v", m, got)
+	}
+}
+
+type deletingChannel struct {
+	deleted  string
+	messages int
+	closed   bool
+}
+
+func (ch *deletingChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	ch.deleted = name
+	return ch.messages, nil
+}
+
+func (ch *deletingChannel) Close() error {
+	ch.closed = true
+	return nil
+}
+
+func TestDeleteQueueWarns(t *testing.T) {
+	logger := &recordingLogger{}
+	r := newTestRabbus(&fakeChannel{}, Config{Logger: logger})
+	ch := &deletingChannel{messages: 3}
+
+	if err := r.deleteQueue(ch, "test_q"); err != nil {
+		t.Fatalf("Expected to delete the queue %s", err)
+	}
+
+	if ch.deleted != "test_q" || !ch.closed {
+		t.Errorf("Expected test_q to be deleted and the channel closed, got %+v", ch)
+	}
+
+	want := "rabbus: warning, queue test_q deleted with 3 messages to be declared again with different arguments"
+	if len(*logger) != 1 || (*logger)[0] != want {
+		t.Errorf("Expected the warning %q, got %v", want, *logger)
+	}
+}
+
+func TestRetryBackoffWaitsBetweenAttempts(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{ReconnectSleep: 10 * time.Millisecond, ReconnectMaxSleep: time.Second})
+
+	var attempts []time.Time
+	r.retryBackoff(func() bool {
+		attempts = append(attempts, time.Now())
+		return len(attempts) == 3
+	})
+
+	if len(attempts) != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", len(attempts))
+	}
+
+	for i, min := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond} {
+		if d := attempts[i+1].Sub(attempts[i]); d < min {
+			t.Errorf("Expected to wait at least %s before attempt %d, got %s", min, i+2, d)
+		}
+	}
+}
+
+func TestRetryBackoffStopsOnClose(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{ReconnectSleep: time.Hour})
+
+	attempts := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.retryBackoff(func() bool {
+			attempts++
+			return false
+		})
+	}()
+
+	close(r.closed)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected to stop retrying once closed")
+	}
+
+	if attempts != 1 {
+		t.Errorf("Expected a single attempt, got %d", attempts)
+	}
+}
+
+func TestRecoverConsumerSkipsReplacedConnection(t *testing.T) {
+	logger := &recordingLogger{}
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1, Logger: logger})
+	c := &consumer{config: ListenConfig{Queue: "test_q"}}
+	r.consumers = []*consumer{c}
+
+	// the connection was replaced by another reconnect, or c cancelled, before c was recovered.
+	r.recoverConsumer(&amqp.Connection{}, c)
+	r.consumers = nil
+	r.recoverConsumer(r.conn, c)
+
+	if c.session != nil || len(*logger) != 0 {
+		t.Fatalf("Expected the consumer to be left alone, got %v", *logger)
+	}
+}
+
+func TestPrefixed(t *testing.T) {
+	tests := []struct {
+		scenario string
+		prefix   string
+		config   ListenConfig
+		expected ListenConfig
+	}{
+		{
+			"no prefix",
+			"",
+			ListenConfig{Exchange: "test_ex", Queue: "test_q"},
+			ListenConfig{Exchange: "test_ex", Queue: "test_q"},
+		},
+		{
+			"prefix",
+			"app_",
+			ListenConfig{Exchange: "test_ex", Queue: "test_q", Bindings: []Binding{{Exchange: "other_ex"}}},
+			ListenConfig{Exchange: "app_test_ex", Queue: "app_test_q", Bindings: []Binding{{Exchange: "app_other_ex"}}},
+		},
+		{
+			"amq. names",
+			"app_",
+			ListenConfig{Exchange: "amq.topic", Queue: "amq.gen-test", Bindings: []Binding{{Exchange: "amq.direct"}}},
+			ListenConfig{Exchange: "amq.topic", Queue: "amq.gen-test", Bindings: []Binding{{Exchange: "amq.direct"}}},
+		},
+		{
+			"server named queue",
+			"app_",
+			ListenConfig{Exchange: "test_ex", Exclusive: true},
+			ListenConfig{Exchange: "app_test_ex", Exclusive: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			r := newTestRabbus(&fakeChannel{}, Config{NamePrefix: test.prefix})
+
+			c := r.prefixed(test.config)
+			if c.Exchange != test.expected.Exchange || c.Queue != test.expected.Queue {
+				t.Fatalf("Expected exchange %q and queue %q, got %q and %q", test.expected.Exchange, test.expected.Queue, c.Exchange, c.Queue)
+			}
+
+			if len(c.Bindings) != len(test.expected.Bindings) {
+				t.Fatalf("Expected %d bindings, got %d", len(test.expected.Bindings), len(c.Bindings))
+			}
+
+			for i, b := range c.Bindings {
+				if b.Exchange != test.expected.Bindings[i].Exchange {
+					t.Errorf("Expected binding exchange %q, got %q", test.expected.Bindings[i].Exchange, b.Exchange)
+				}
+			}
+
+			if r.name("") != "" {
+				t.Errorf("Expected the default exchange to keep its empty name")
+			}
+		})
+	}
+}
+
+// closedConnection returns a connection whose broker went away during the handshake.
+func closedConnection(t *testing.T) *amqp.Connection {
+	client, server := net.Pipe()
+	server.Close()
+
+	conn, err := amqp.Open(client, amqp.Config{})
+	if err == nil {
+		t.Fatal("Expected the handshake to fail")
+	}
+	<-conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	return conn
+}
+
+func TestTryListen(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1})
+
+	if _, _, err := r.TryListen(ListenConfig{Exchange: "test_ex", Queue: "test_q"}); err != ErrMissingKind {
+		t.Fatalf("Expected the config to be validated right away, got %v", err)
+	}
+
+	r.conn = closedConnection(t)
+	messages, ready, err := r.TryListen(ListenConfig{Exchange: "test_ex", Kind: "direct", Queue: "test_q"})
+	if err != nil || messages == nil {
+		t.Fatalf("Expected the consumer to be set up in the background, got %v", err)
+	}
+
+	select {
+	case err := <-ready:
+		if err != amqp.ErrClosed {
+			t.Fatalf("Expected the setup failure to be reported, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the result of the setup to be sent")
+	}
+
+	if len(r.consumers) != 0 {
+		t.Fatalf("Expected the failed consumer not to be registered, got %d", len(r.consumers))
+	}
+}
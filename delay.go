@@ -0,0 +1,21 @@
+package rabbus
+
+import "github.com/streadway/amqp"
+
+const (
+	// ExchangeDelayed is the exchange type of the rabbitmq_delayed_message_exchange plugin, holding
+	// each message for the delay in its DelayHeader before routing it like a direct exchange.
+	ExchangeDelayed = "x-delayed-message"
+	// DelayHeader is the header carrying the delay in milliseconds of a message published to an
+	// ExchangeDelayed exchange, set from Message.Delay.
+	DelayHeader = "x-delay"
+)
+
+// exchangeArgs returns the arguments declaring an exchange of type kind.
+func exchangeArgs(kind string) amqp.Table {
+	if kind != ExchangeDelayed {
+		return nil
+	}
+
+	return amqp.Table{"x-delayed-type": "direct"}
+}
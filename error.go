@@ -2,6 +2,7 @@ package rabbus
 
 import (
 	"errors"
+	"fmt"
 )
 
 var (
@@ -13,4 +14,64 @@ var (
 	ErrMissingQueue = errors.New("Missing field queue")
 	// ErrMissingHandler is returned when function handler is not passed as parameter.
 	ErrMissingHandler = errors.New("Missing field handler")
+	// ErrInvalidDeliveryMode is returned when the delivery mode is neither Transient nor Persistent.
+	ErrInvalidDeliveryMode = errors.New("Invalid delivery mode")
+	// ErrInvalidExpiration is returned when the message expiration is not a number of milliseconds.
+	ErrInvalidExpiration = errors.New("Invalid expiration")
+	// ErrInvalidRoutingKey is returned when the routing key of a message to a topic exchange has an empty word
+	// or a wildcard within a word, see Config.ValidateRoutingKey.
+	ErrInvalidRoutingKey = errors.New("Invalid routing key")
+	// ErrInvalidBatchSize is returned when the batch size is not a positive number.
+	ErrInvalidBatchSize = errors.New("Invalid batch size")
+	// ErrInvalidShards is returned when the number of shards is not a positive number.
+	ErrInvalidShards = errors.New("Invalid number of shards")
+	// ErrUnknownContentType is returned when there is no codec registered for the message content-type.
+	ErrUnknownContentType = errors.New("Unknown content type")
+	// ErrCircuitOpen is returned when a message is not published because the circuit breaker is open.
+	ErrCircuitOpen = errors.New("Circuit breaker is open")
+	// ErrStaleDelivery is returned when acknowledging a message received from a channel that is gone,
+	// e.g. after a reconnect.
+	ErrStaleDelivery = errors.New("Stale delivery")
+	// ErrMissingDeathHeader is returned when replaying a message without the x-death header
+	// recording its original destination.
+	ErrMissingDeathHeader = errors.New("Missing header x-death")
+	// ErrQueueMismatch is returned when the queue already exists with different properties or arguments,
+	// the broker refuses to declare it again until it is deleted.
+	ErrQueueMismatch = errors.New("Queue exists with different arguments")
+	// ErrReject is returned by a handler to reject the message without requeueing it.
+	ErrReject = errors.New("Message rejected")
+	// ErrConnectionBlocked is returned when the broker keeps the connection blocked for longer than Config.BlockedTimeout.
+	ErrConnectionBlocked = errors.New("Connection blocked by broker")
+	// ErrClosed is returned when publishing after the Rabbus was closed.
+	ErrClosed = errors.New("Rabbus is closed")
+	// ErrNacked is returned when the broker refuses to take responsibility for a published message.
+	ErrNacked = errors.New("Message nacked by broker")
+	// ErrConfirmsDisabled is returned when waiting for a publisher confirm while confirms are not enabled.
+	ErrConfirmsDisabled = errors.New("Publisher confirms are disabled")
+	// ErrConfirmLost is returned when the channel is closed before the broker confirmed a published message.
+	ErrConfirmLost = errors.New("Message confirm lost")
+	// ErrUnorderedAck is returned when listening with AckBatch or AckInterval and ListenConfig.Concurrency,
+	// those strategies ack every message before the last one handled, so the messages must be handled in order.
+	ErrUnorderedAck = errors.New("Ack strategy requires messages handled in order")
+	// ErrInvalidAckStrategy is returned when listening with AckBatch and a size not positive or exceeding
+	// ListenConfig.PrefetchCount, or with AckInterval and an interval not positive, the messages would never be acked.
+	ErrInvalidAckStrategy = errors.New("Ack strategy never acks")
+	// ErrConnectionClosed is returned when the connection is lost before the broker confirmed a published message,
+	// the message may or may not have been delivered.
+	ErrConnectionClosed = errors.New("Connection closed before confirm")
+	// ErrNotRetryable is returned by ConsumerMessage.Retry for a message not delivered to a consumer,
+	// e.g. one built with NewConsumerMessage, there is no rabbus to republish it.
+	ErrNotRetryable = errors.New("Message not delivered to a consumer")
 )
+
+// BatchError is returned by EmitBatch when a message of the batch fails to be published.
+type BatchError struct {
+	// Sent is the number of messages, from the start of the batch, published before the failed one.
+	Sent int
+	// Err is the error of the failed message.
+	Err error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("Batch failed after %d messages: %s", e.Sent, e.Err)
+}
@@ -0,0 +1,116 @@
+package rabbus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// defaultBlockedTimeout is how long publishing waits for a blocked connection when Config.BlockedTimeout is not set.
+const defaultBlockedTimeout = 30 * time.Second
+
+// flow tracks whether the broker blocked the connection, e.g. on a memory or disk alarm.
+type flow struct {
+	sync.Mutex
+	// unblocked is closed once the connection is unblocked, nil while it is not blocked.
+	unblocked chan struct{}
+}
+
+func (f *flow) block() {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.unblocked == nil {
+		f.unblocked = make(chan struct{})
+	}
+}
+
+func (f *flow) unblock() {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.unblocked != nil {
+		close(f.unblocked)
+		f.unblocked = nil
+	}
+}
+
+// wait blocks while the connection is blocked, up to timeout, and reports whether it is unblocked.
+func (f *flow) wait(timeout time.Duration) bool {
+	f.Lock()
+	unblocked := f.unblocked
+	f.Unlock()
+
+	if unblocked == nil {
+		return true
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-unblocked:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// watchBlocked follows the blocked notifications of conn until it is closed, logging them. Once conn was
+// replaced by a reconnect its notifications are ignored, the flow state is the one of the new connection.
+func (r *rabbus) watchBlocked(conn *amqp.Connection) {
+	for b := range conn.NotifyBlocked(make(chan amqp.Blocking, 1)) {
+		if !r.setBlocked(conn, b.Active) {
+			continue
+		}
+
+		if b.Active {
+			r.config.logf("rabbus: connection blocked by broker: %s", b.Reason)
+		} else {
+			r.config.logf("rabbus: connection unblocked by broker")
+		}
+
+		if r.config.OnBlocked != nil {
+			r.config.OnBlocked(b.Active, b.Reason)
+		}
+	}
+
+	r.setBlocked(conn, false)
+}
+
+// setBlocked blocks or unblocks the flow as notified by conn, unless conn is not the current connection,
+// and reports whether it is. The read lock keeps a reconnect from swapping the connection meanwhile.
+func (r *rabbus) setBlocked(conn *amqp.Connection, blocked bool) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	if r.conn != conn {
+		return false
+	}
+
+	if blocked {
+		r.flow.block()
+	} else {
+		r.flow.unblock()
+	}
+
+	return true
+}
+
+// waitUnblocked waits for the connection to be unblocked before publishing, so the publishing does not
+// burn its retries against a connection the broker refuses to read from. The publishing failing with
+// ErrConnectionBlocked is logged, and counted as an error by the MetricsObserver along with the others.
+func (r *rabbus) waitUnblocked() error {
+	timeout := r.config.BlockedTimeout
+	if timeout <= 0 {
+		timeout = defaultBlockedTimeout
+	}
+
+	if !r.flow.wait(timeout) {
+		r.config.logf("rabbus: connection still blocked by broker after %s, giving up publishing", timeout)
+		return ErrConnectionBlocked
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package rabbus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestFlowWaitsWhileBlocked(t *testing.T) {
+	var f flow
+	if !f.wait(time.Millisecond) {
+		t.Fatal("Expected not to wait while unblocked")
+	}
+
+	f.block()
+	if f.wait(time.Millisecond) {
+		t.Fatal("Expected to time out while blocked")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		f.unblock()
+	}()
+
+	if !f.wait(time.Second) {
+		t.Fatal("Expected to resume once unblocked")
+	}
+}
+
+func TestSetBlockedIgnoresReplacedConnection(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	old := &amqp.Connection{}
+	r.conn = &amqp.Connection{}
+
+	if !r.setBlocked(r.conn, true) {
+		t.Fatal("Expected the current connection to block the flow")
+	}
+
+	// the old connection is closed once the new one was blocked already.
+	if r.setBlocked(old, false) {
+		t.Fatal("Expected the replaced connection to be ignored")
+	}
+
+	if r.flow.wait(time.Millisecond) {
+		t.Fatal("Expected the flow to stay blocked by the current connection")
+	}
+}
+
+func TestWaitUnblockedLogsTimeout(t *testing.T) {
+	logger := &recordingLogger{}
+	r := newTestRabbus(&fakeChannel{}, Config{BlockedTimeout: time.Millisecond, Logger: logger})
+
+	r.flow.block()
+	if err := r.waitUnblocked(); err != ErrConnectionBlocked {
+		t.Fatalf("Expected %v, got %v", ErrConnectionBlocked, err)
+	}
+
+	if len(*logger) != 1 {
+		t.Fatalf("Expected the blocked publishing to be logged, got %v", *logger)
+	}
+}
@@ -0,0 +1,247 @@
+package rabbus
+
+import (
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// AckMode selects who acknowledges the deliveries handed to a handler.
+type AckMode int
+
+const (
+	// AutoAck settles each delivery according to the handler result: nil acks it, ErrReject
+	// rejects it without requeueing, so it is dead-lettered if the queue has a dead letter exchange,
+	// and any other error nacks and requeues it.
+	AutoAck AckMode = iota
+	// ManualAck leaves the acknowledgement to the handler, which must call Ack, Nack or Reject
+	// on every message, e.g. only after committing its own transaction. The handler result is ignored.
+	ManualAck
+)
+
+// Listener is a handle on a consumer started by ListenWithHandler or ListenWithCancel.
+type Listener struct {
+	consumer *consumer
+	rabbus   *rabbus
+	// stop cancels the consumer, once, returning the channel closed once its deliveries are handled.
+	stop func() (<-chan struct{}, error)
+	once sync.Once
+	done chan struct{}
+}
+
+// Stop cancels the consumer, so it is not subscribed again after a reconnect, and returns the error
+// cancelling its ListenConfig.ConsumerTag. It does not wait for the deliveries being handled, so a
+// handler may stop its own consumer, see Done. The messages not acknowledged are redelivered by the broker.
+// The queue and its bindings are left, see Unbind. Stopping again does nothing.
+func (l *Listener) Stop() (err error) {
+	l.once.Do(func() {
+		var handled <-chan struct{}
+		handled, err = l.stop()
+		go func() {
+			<-handled
+			close(l.done)
+		}()
+	})
+
+	return err
+}
+
+// Done returns a channel closed once the consumer is stopped and the deliveries being handled are done,
+// the channel returned by ListenWithCancel is closed then.
+func (l *Listener) Done() <-chan struct{} {
+	return l.done
+}
+
+// Unbind removes the bindings of the ListenConfig from the queue, e.g. to stop receiving
+// the messages of an exchange at runtime. The queue keeps the messages already routed to it.
+func (l *Listener) Unbind() error {
+	_, queue := l.consumer.channel()
+
+	ch, err := l.rabbus.openChannel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for _, b := range l.consumer.config.bindings() {
+		if err := ch.QueueUnbind(queue, b.Key, b.Exchange, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InFlight returns the number of messages delivered to the consumer and not acknowledged yet.
+// A steadily rising count means the handler is too slow or does not acknowledge every message.
+func (l *Listener) InFlight() int {
+	return l.consumer.inFlight()
+}
+
+// ListenWithHandler consumes the queue described by c, calling handler for each delivery, one at a time
+// unless c.Concurrency is set, and settling it according to c.AckMode and c.AckStrategy.
+// With c.RetryDelays, failed messages are retried after each delay in turn and then moved
+// to the dead queue, in AutoAck mode.
+func (r *rabbus) ListenWithHandler(c ListenConfig, handler func(ConsumerMessage) error) (*Listener, error) {
+	if err := validateListenConfig(c); err != nil {
+		return nil, err
+	}
+
+	if handler == nil {
+		return nil, ErrMissingHandler
+	}
+
+	if a, ok := c.AckStrategy.(*ackDeferred); ok {
+		if c.Concurrency > 1 {
+			return nil, ErrUnorderedAck
+		}
+
+		if err := a.validate(c.settings().prefetchCount); err != nil {
+			return nil, err
+		}
+		a.logf = r.config.logf
+	}
+
+	config := r.prefixed(c)
+	cons := &consumer{
+		config:   config,
+		settings: c.settings(),
+		setup:    bindQueue,
+		handle:   r.handleWith(c, config, handler),
+	}
+
+	if err := r.consume(cons); err != nil {
+		return nil, err
+	}
+
+	return r.newListener(cons), nil
+}
+
+// newListener returns the Listener of cons, stopping it cancels cons.
+func (r *rabbus) newListener(cons *consumer) *Listener {
+	return r.listener(cons, func() (<-chan struct{}, error) {
+		err := r.cancel(cons)
+		return cons.handled(), err
+	})
+}
+
+// listener returns the Listener of cons stopped by stop.
+func (r *rabbus) listener(cons *consumer, stop func() (<-chan struct{}, error)) *Listener {
+	return &Listener{consumer: cons, rabbus: r, stop: stop, done: make(chan struct{})}
+}
+
+// handleWith returns the func handing the deliveries of the consumer described by c, and its
+// prefixed config, to handler. Stale deliveries are dropped, the broker redelivers them to the
+// recovered subscription.
+func (r *rabbus) handleWith(c, config ListenConfig, handler func(ConsumerMessage) error) func(<-chan amqp.Delivery, *session) {
+	if c.DedupStore != nil {
+		handler = dedup(c.DedupStore, c.DedupHeader, c.AckMode == ManualAck, handler)
+	}
+
+	strategy := c.AckStrategy
+	if strategy == nil {
+		strategy = AckAfterHandler()
+	}
+
+	return func(msgs <-chan amqp.Delivery, s *session) {
+		process := func(m ConsumerMessage) {
+			if m.Stale() {
+				return
+			}
+
+			if c.AckMode == ManualAck {
+				handler(m)
+				return
+			}
+
+			strategy.Received(m)
+			err := handler(m)
+			if err != nil && err != ErrReject && len(c.RetryDelays) > 0 {
+				// once the copy is in the delay queue the message is done with.
+				err = r.retry(m, config)
+			}
+			strategy.Handled(m, err)
+		}
+		defer strategy.Flush()
+
+		switch {
+		case c.Concurrency > 1 && c.Unordered:
+			pool(msgs, s, c.Concurrency, process)
+			return
+		case c.Concurrency > 1:
+			partition(msgs, s, c.Concurrency, c.partitionKey(), process)
+			return
+		}
+
+		for d := range msgs {
+			process(newConsumerMessage(d, s))
+		}
+	}
+}
+
+// partition processes the deliveries on workers goroutines, the messages with the same key
+// always going to the same worker so they are processed in order. It returns once the deliveries
+// stop and every worker is done.
+func partition(msgs <-chan amqp.Delivery, s *session, workers int, key func(ConsumerMessage) string, process func(ConsumerMessage)) {
+	var wg sync.WaitGroup
+	queues := make([]chan ConsumerMessage, workers)
+	for i := range queues {
+		queues[i] = make(chan ConsumerMessage)
+		wg.Add(1)
+		go func(q <-chan ConsumerMessage) {
+			defer wg.Done()
+			for m := range q {
+				process(m)
+			}
+		}(queues[i])
+	}
+
+	for d := range msgs {
+		m := newConsumerMessage(d, s)
+		queues[fnv32a(key(m))%uint32(workers)] <- m
+	}
+
+	for _, q := range queues {
+		close(q)
+	}
+	wg.Wait()
+}
+
+// pool processes the deliveries on workers goroutines, each of them taking the next delivery
+// once done with the previous one. It returns once the deliveries stop and every worker is done.
+func pool(msgs <-chan amqp.Delivery, s *session, workers int, process func(ConsumerMessage)) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range msgs {
+				process(newConsumerMessage(d, s))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// partitionKey returns the function extracting the ordering key of the messages, default to the routing key.
+func (c ListenConfig) partitionKey() func(ConsumerMessage) string {
+	if c.PartitionKey != nil {
+		return c.PartitionKey
+	}
+
+	return func(m ConsumerMessage) string {
+		return m.Key
+	}
+}
+
+// settle acknowledges m according to err, the result of handling it.
+func settle(m ConsumerMessage, err error) error {
+	switch err {
+	case nil:
+		return m.Ack(false)
+	case ErrReject:
+		return m.Reject(false)
+	default:
+		return m.Nack(false, true)
+	}
+}
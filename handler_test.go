@@ -0,0 +1,210 @@
+package rabbus
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestSettle(t *testing.T) {
+	tests := []struct {
+		scenario string
+		err      error
+		expected string
+	}{
+		{"ack on success", nil, "ack"},
+		{"reject on ErrReject", ErrReject, "reject"},
+		{"requeue on error", errors.New("failed"), "requeue"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			ack := &acknowledger{}
+			m := newConsumerMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}, nil)
+
+			if err := settle(m, test.err); err != nil {
+				t.Fatalf("Expected to settle message %s", err)
+			}
+
+			if ack.last != test.expected {
+				t.Fatalf("Expected %s, got %s", test.expected, ack.last)
+			}
+		})
+	}
+}
+
+func TestPartitionKeepsOrderPerKey(t *testing.T) {
+	msgs := make(chan amqp.Delivery)
+	go func() {
+		for tag := uint64(1); tag <= 100; tag++ {
+			key := "even"
+			if tag%2 == 1 {
+				key = "odd"
+			}
+			msgs <- amqp.Delivery{RoutingKey: key, DeliveryTag: tag}
+		}
+		close(msgs)
+	}()
+
+	var mu sync.Mutex
+	last := make(map[string]uint64)
+	partition(msgs, nil, 4, ListenConfig{}.partitionKey(), func(m ConsumerMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if m.DeliveryTag < last[m.Key] {
+			t.Errorf("Expected %s messages in order, got %d after %d", m.Key, m.DeliveryTag, last[m.Key])
+		}
+		last[m.Key] = m.DeliveryTag
+	})
+
+	if last["odd"] != 99 || last["even"] != 100 {
+		t.Fatalf("Expected every message to be processed, got %v", last)
+	}
+}
+
+func TestHandleWithDropsStaleDeliveries(t *testing.T) {
+	for _, concurrency := range []int{1, 4} {
+		c := ListenConfig{Concurrency: concurrency}
+		r := newTestRabbus(&fakeChannel{}, Config{})
+		ack := &acknowledger{}
+
+		var mu sync.Mutex
+		handled := 0
+		handle := r.handleWith(c, c, func(ConsumerMessage) error {
+			mu.Lock()
+			defer mu.Unlock()
+			handled++
+			return nil
+		})
+
+		s := newSession()
+		s.markStale()
+
+		msgs := make(chan amqp.Delivery, 2)
+		msgs <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+		msgs <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 2}
+		close(msgs)
+		handle(msgs, s)
+
+		if handled != 0 || ack.acks != 0 {
+			t.Errorf("Expected stale deliveries to be dropped with concurrency %d, got %d handled and %d acks", concurrency, handled, ack.acks)
+		}
+	}
+}
+
+func TestPoolHandlesSameKeyConcurrently(t *testing.T) {
+	msgs := make(chan amqp.Delivery, 4)
+	for tag := uint64(1); tag <= 4; tag++ {
+		msgs <- amqp.Delivery{RoutingKey: "orders", DeliveryTag: tag}
+	}
+	close(msgs)
+
+	// every worker waits for the others, so the pool only returns if all of them run at once.
+	var started sync.WaitGroup
+	started.Add(4)
+	pool(msgs, nil, 4, func(ConsumerMessage) {
+		started.Done()
+		started.Wait()
+	})
+}
+
+func TestListenerStopOnce(t *testing.T) {
+	stops := 0
+	cancelled := errors.New("cancel failed")
+	l := (&rabbus{}).listener(&consumer{}, func() (<-chan struct{}, error) {
+		stops++
+		return nil, cancelled
+	})
+
+	if err := l.Stop(); err != cancelled {
+		t.Fatalf("Expected the error cancelling the consumer, got %v", err)
+	}
+	if err := l.Stop(); err != nil {
+		t.Fatalf("Expected stopping again to do nothing, got %v", err)
+	}
+
+	if stops != 1 {
+		t.Errorf("Expected the consumer to be cancelled once, got %d", stops)
+	}
+}
+
+func TestListenerStopFromHandler(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	cons := &consumer{}
+	r.consumers = []*consumer{cons}
+	l := r.newListener(cons)
+
+	// the handler stopping the listener is a delivery being handled.
+	cons.handling.Add(1)
+	stopped := make(chan error, 1)
+	go func() {
+		defer cons.handling.Done()
+		stopped <- l.Stop()
+	}()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("Expected to stop, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the handler to stop its own listener")
+	}
+
+	select {
+	case <-l.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected Done to be closed once the handler returned")
+	}
+
+	if len(r.consumers) != 0 {
+		t.Errorf("Expected the consumer to be cancelled, got %d consumers", len(r.consumers))
+	}
+}
+
+func TestForwarderStopsOnDone(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	messages := make(chan ConsumerMessage)
+	done := make(chan struct{})
+	cons := r.forwarder(ListenConfig{}, messages, done)
+
+	msgs := make(chan amqp.Delivery, 2)
+	msgs <- amqp.Delivery{DeliveryTag: 1}
+	msgs <- amqp.Delivery{DeliveryTag: 2}
+	close(msgs)
+
+	// nobody reads messages.
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		cons.handle(msgs, newSession())
+	}()
+	close(done)
+
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the forwarder to stop sending the unread messages once done")
+	}
+}
+
+func TestListenerUnbind(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	r.openChannel = func() (amqpChannel, error) { return ch, nil }
+
+	c := ListenConfig{Exchange: "orders", Kind: "topic", Key: "orders.#", Queue: "billing", Bindings: []Binding{{Exchange: "refunds", Kind: "topic", Key: "#"}}}
+	l := &Listener{consumer: &consumer{config: c, queue: "billing"}, rabbus: r.rabbus}
+
+	if err := l.Unbind(); err != nil {
+		t.Fatalf("Expected to unbind the queue, got %v", err)
+	}
+
+	if len(ch.unbound) != 2 || ch.unbound[0] != "orders->billing" || ch.unbound[1] != "refunds->billing" {
+		t.Errorf("Expected the queue to be unbound from every exchange, got %v", ch.unbound)
+	}
+}
@@ -0,0 +1,163 @@
+package rabbus
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the header carrying the idempotency key of messages published by EmitIdempotent.
+const IdempotencyKeyHeader = "x-idempotency-key"
+
+const defaultDedupSize = 10000
+
+// EmitIdempotent publishes m with key as its message id and IdempotencyKeyHeader header, and waits for the
+// result, so a transactional outbox relay can mark the message as sent only once it is delivered.
+// Enable publisher confirms with Config.EnablePublisherConfirms, or Config.ConfirmBatchWindow for higher
+// throughput, to wait for the broker to take responsibility for the message, a nacked message fails with
+// ErrNacked. The relay may publish a message more than once, e.g. crashing before marking it
+// as sent, consumers drop the duplicates with Dedup.
+func (r *rabbus) EmitIdempotent(m Message, key string) error {
+	m.MessageId, m.idempotencyKey = key, key
+
+	_, err := r.do(func(l *lane, done published) {
+		l.send(context.Background(), m, true, done)
+	})
+	return err
+}
+
+// DedupStore records the idempotency keys of the messages already processed.
+// Implementations must be safe for concurrent use, e.g. backed by Redis to share them between instances.
+type DedupStore interface {
+	// Contains reports whether key was added.
+	Contains(key string) (bool, error)
+	// Add records key as processed.
+	Add(key string) error
+}
+
+// Dedup wraps handler for ListenWithHandler, acking without calling handler the messages whose idempotency
+// key, from the IdempotencyKeyHeader header or else the message id, is in store. The key of a message is
+// added to store only once handler succeeds, so failed messages are still processed when redelivered.
+// Messages without a key are always handled.
+func Dedup(store DedupStore, handler func(ConsumerMessage) error) func(ConsumerMessage) error {
+	return dedup(store, "", false, handler)
+}
+
+// dedup wraps handler skipping the duplicates, identified by the header when not empty,
+// acking them itself when ack is true.
+func dedup(store DedupStore, header string, ack bool, handler func(ConsumerMessage) error) func(ConsumerMessage) error {
+	return func(m ConsumerMessage) error {
+		key := m.idempotencyKey(header)
+		if key == "" {
+			return handler(m)
+		}
+
+		seen, err := store.Contains(key)
+		if err != nil {
+			return err
+		}
+		if seen {
+			if ack {
+				return m.Ack(false)
+			}
+			return nil
+		}
+
+		if err := handler(m); err != nil {
+			return err
+		}
+
+		return store.Add(key)
+	}
+}
+
+// idempotencyKey returns the key identifying the message among its duplicates, from header when
+// it is not empty, otherwise from the IdempotencyKeyHeader header or else the message id.
+func (cm *ConsumerMessage) idempotencyKey(header string) string {
+	if header != "" {
+		key, _ := cm.Headers[header].(string)
+		return key
+	}
+
+	if key, ok := cm.Headers[IdempotencyKeyHeader].(string); ok && key != "" {
+		return key
+	}
+
+	return cm.MessageId
+}
+
+// MemoryDedupStore is a DedupStore keeping the most recent keys in memory, evicting the oldest ones
+// once full or expired. It only detects duplicates received by the same process.
+type MemoryDedupStore struct {
+	sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+type dedupEntry struct {
+	key   string
+	added time.Time
+}
+
+// NewMemoryDedupStore returns a MemoryDedupStore remembering up to size keys, 10000 when size is not positive,
+// each for ttl, forever when ttl is not positive.
+func NewMemoryDedupStore(size int, ttl time.Duration) *MemoryDedupStore {
+	if size <= 0 {
+		size = defaultDedupSize
+	}
+
+	return &MemoryDedupStore{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		keys:  make(map[string]*list.Element),
+	}
+}
+
+// Contains reports whether key is among the recent keys.
+func (s *MemoryDedupStore) Contains(key string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.expire(time.Now())
+	_, ok := s.keys[key]
+	return ok, nil
+}
+
+// Add records key, evicting the oldest key when the store is full.
+func (s *MemoryDedupStore) Add(key string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	s.expire(now)
+	if _, ok := s.keys[key]; ok {
+		return nil
+	}
+
+	s.keys[key] = s.order.PushBack(dedupEntry{key: key, added: now})
+	for s.order.Len() > s.size {
+		s.evict(s.order.Front())
+	}
+
+	return nil
+}
+
+// expire evicts the keys older than the ttl, the oldest keys being at the front.
+func (s *MemoryDedupStore) expire(now time.Time) {
+	if s.ttl <= 0 {
+		return
+	}
+
+	for e := s.order.Front(); e != nil && now.Sub(e.Value.(dedupEntry).added) >= s.ttl; e = s.order.Front() {
+		s.evict(e)
+	}
+}
+
+func (s *MemoryDedupStore) evict(e *list.Element) {
+	s.order.Remove(e)
+	delete(s.keys, e.Value.(dedupEntry).key)
+}
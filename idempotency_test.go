@@ -0,0 +1,93 @@
+package rabbus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestDedup(t *testing.T) {
+	store := NewMemoryDedupStore(1, 0)
+
+	var calls int
+	fail := true
+	handler := Dedup(store, func(ConsumerMessage) error {
+		calls++
+		if fail {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	m := newConsumerMessage(amqp.Delivery{Headers: amqp.Table{IdempotencyKeyHeader: "order-1"}}, nil)
+
+	if err := handler(m); err == nil {
+		t.Fatal("Expected the handler error")
+	}
+
+	fail = false
+	for i := 0; i < 2; i++ {
+		if err := handler(m); err != nil {
+			t.Fatalf("Expected to handle message %s", err)
+		}
+	}
+
+	if calls != 2 {
+		t.Fatalf("Expected the duplicate to be skipped, handler called %d times", calls)
+	}
+
+	other := newConsumerMessage(amqp.Delivery{MessageId: "order-2"}, nil)
+	if err := handler(other); err != nil {
+		t.Fatalf("Expected to handle message %s", err)
+	}
+
+	if seen, _ := store.Contains("order-1"); seen {
+		t.Fatal("Expected the oldest key to be evicted")
+	}
+}
+
+func TestEmitIdempotentNacked(t *testing.T) {
+	tests := []struct {
+		scenario string
+		config   Config
+	}{
+		{"publisher confirms", Config{Attempts: 1, EnablePublisherConfirms: true}},
+		{"confirm batch window", Config{Attempts: 1, ConfirmBatchWindow: time.Millisecond}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			ch := &fakeChannel{nack: 1}
+			r := newTestRabbus(ch, test.config)
+			r.trackConfirms(ch)
+			go r.register()
+			defer r.shutdown(time.Second)
+
+			m := Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}
+			if err := r.EmitIdempotent(m, "order-1"); err != ErrNacked {
+				t.Fatalf("Expected the broker nack to fail with %v, got %v", ErrNacked, err)
+			}
+
+			if len(ch.published) != 1 || ch.published[0].pub.MessageId != "order-1" {
+				t.Fatalf("Expected the message published once with its idempotency key, got %+v", ch.published)
+			}
+		})
+	}
+}
+
+func TestMemoryDedupStoreExpires(t *testing.T) {
+	store := NewMemoryDedupStore(10, 10*time.Millisecond)
+	store.Add("order-1")
+
+	if seen, _ := store.Contains("order-1"); !seen {
+		t.Fatal("Expected the key to be remembered")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if seen, _ := store.Contains("order-1"); seen {
+		t.Fatal("Expected the key to expire")
+	}
+}
@@ -0,0 +1,14 @@
+package rabbus
+
+// Logger logs what happens inside rabbus, e.g. the reconnect attempts and the retried publishings.
+// *log.Logger implements it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// logf logs through the configured Logger, nothing is logged without one.
+func (c Config) logf(format string, args ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Printf(format, args...)
+	}
+}
@@ -0,0 +1,25 @@
+package rabbus
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+type recordingLogger []string
+
+func (l *recordingLogger) Printf(format string, args ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, args...))
+}
+
+func TestSendLogsRetries(t *testing.T) {
+	logger := &recordingLogger{}
+	ch := &fakeChannel{failPublish: 1}
+	r := newTestRabbus(ch, Config{Attempts: 2, Logger: logger})
+
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}, true, func(Receipt, error) {})
+
+	if len(*logger) != 1 {
+		t.Fatalf("Expected the failed attempt to be logged, got %v", *logger)
+	}
+}
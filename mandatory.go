@@ -0,0 +1,21 @@
+package rabbus
+
+import "github.com/streadway/amqp"
+
+// returner is the part of amqp.Channel needed to be told about unroutable messages.
+type returner interface {
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+}
+
+// watchReturns calls Config.OnReturn with every message the broker returns on the producer channel ch,
+// until the channel is closed. Returns are only listened to with a callback, amqp would otherwise
+// block the channel on the first of them.
+func (r *rabbus) watchReturns(ch returner) {
+	if r.config.OnReturn == nil {
+		return
+	}
+
+	for ret := range ch.NotifyReturn(make(chan amqp.Return, 1)) {
+		r.config.OnReturn(ret)
+	}
+}
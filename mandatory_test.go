@@ -0,0 +1,34 @@
+package rabbus
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+type fakeReturner struct {
+	returns []amqp.Return
+}
+
+func (f *fakeReturner) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	go func() {
+		for _, ret := range f.returns {
+			c <- ret
+		}
+		close(c)
+	}()
+	return c
+}
+
+func TestWatchReturns(t *testing.T) {
+	var returned []string
+	r := &rabbus{config: Config{OnReturn: func(ret amqp.Return) {
+		returned = append(returned, ret.RoutingKey)
+	}}}
+
+	r.watchReturns(&fakeReturner{returns: []amqp.Return{{RoutingKey: "a"}, {RoutingKey: "b"}}})
+
+	if len(returned) != 2 || returned[0] != "a" || returned[1] != "b" {
+		t.Fatalf("Expected every returned message in order, got %v", returned)
+	}
+}
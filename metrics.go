@@ -0,0 +1,37 @@
+package rabbus
+
+import "time"
+
+// MetricsObserver is told about every publishing and the CircuitBreaker state, e.g. to export them
+// as Prometheus counters and gauges. Implementations must be safe for concurrent use.
+type MetricsObserver interface {
+	// IncEmit counts a message published to exchange.
+	IncEmit(exchange string)
+	// IncEmitError counts a message to exchange which failed to be published.
+	IncEmitError(exchange string)
+	// ObserveEmitDuration observes how long publishing a message took, including the retries
+	// and the broker confirm when confirms are enabled.
+	ObserveEmitDuration(d time.Duration)
+	// SetBreakerState sets the current CircuitBreaker state, "closed", "half-open" or "open".
+	SetBreakerState(state string)
+}
+
+// observe wraps done to report the result of publishing a message to exchange to the MetricsObserver.
+func (r *rabbus) observe(exchange string, done published) published {
+	m := r.config.Metrics
+	if m == nil {
+		return done
+	}
+
+	start := time.Now()
+	return func(r Receipt, err error) {
+		m.ObserveEmitDuration(time.Since(start))
+		if err != nil {
+			m.IncEmitError(exchange)
+		} else {
+			m.IncEmit(exchange)
+		}
+
+		done(r, err)
+	}
+}
@@ -0,0 +1,28 @@
+package rabbus
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type countingObserver struct {
+	emits, errors, durations int
+}
+
+func (o *countingObserver) IncEmit(string)                    { o.emits++ }
+func (o *countingObserver) IncEmitError(string)               { o.errors++ }
+func (o *countingObserver) ObserveEmitDuration(time.Duration) { o.durations++ }
+func (o *countingObserver) SetBreakerState(string)            {}
+
+func TestSendObservesMetrics(t *testing.T) {
+	metrics := &countingObserver{}
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1, Metrics: metrics})
+
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}, true, func(Receipt, error) {})
+	r.send(context.Background(), Message{Exchange: "test_ex", Key: "test_key"}, true, func(Receipt, error) {})
+
+	if metrics.emits != 1 || metrics.errors != 1 || metrics.durations != 2 {
+		t.Fatalf("Expected a publishing and a failure to be observed, got %+v", metrics)
+	}
+}
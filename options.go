@@ -0,0 +1,230 @@
+package rabbus
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"github.com/streadway/amqp"
+)
+
+// Option configures a rabbus started with New.
+type Option func(*Config)
+
+// New starts a rabbus connected to dsn, configured by opts on top of the defaults.
+// Unlike a Config literal, whose zero values can not tell an unset field from a disabled one,
+// only the options passed change the defaults, e.g. queues are durable unless WithDurable(false) is passed.
+func New(dsn string, opts ...Option) (Rabbus, error) {
+	return newRabbus(configure(dsn, opts))
+}
+
+// configure returns the Config for dsn with opts applied on top of the defaults.
+func configure(dsn string, opts []Option) Config {
+	c := Config{Dsn: dsn, Durable: true}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	return c
+}
+
+// withConfig replaces the whole Config with c, it keeps NewRabbus behaving as before options.
+func withConfig(c Config) Option {
+	return func(dst *Config) {
+		*dst = c
+	}
+}
+
+// WithDurable sets whether exchanges and queues survive broker restarts. Default to true.
+func WithDurable(durable bool) Option {
+	return func(c *Config) {
+		c.Durable = durable
+	}
+}
+
+// WithAttempts sets the max number of retries on broker outages.
+func WithAttempts(attempts int) Option {
+	return func(c *Config) {
+		c.Attempts = attempts
+	}
+}
+
+// WithSleep sets the sleep time of the retry mechanism.
+func WithSleep(sleep time.Duration) Option {
+	return func(c *Config) {
+		c.Sleep = sleep
+	}
+}
+
+// WithInterval sets the cyclic period of the closed state for CircuitBreaker to clear the internal counts.
+func WithInterval(interval time.Duration) Option {
+	return func(c *Config) {
+		c.Interval = interval
+	}
+}
+
+// WithTimeout sets the period of the open state, after which the state of CircuitBreaker becomes half-open.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.Timeout = timeout
+	}
+}
+
+// WithRetryBackoff sets the wait after each failed attempt to publish, e.g. JitteredBackoff, instead of the sleep.
+func WithRetryBackoff(fn func(attempt int) time.Duration) Option {
+	return func(c *Config) {
+		c.RetryBackoff = fn
+	}
+}
+
+// WithThreshold sets the number of consecutive failures tripping the CircuitBreaker. Default to 5.
+func WithThreshold(threshold uint32) Option {
+	return func(c *Config) {
+		c.Threshold = threshold
+	}
+}
+
+// WithReadyToTrip sets the predicate deciding whether the CircuitBreaker trips after a failure.
+// Default to trip once the consecutive failures exceed the threshold.
+func WithReadyToTrip(fn func(counts gobreaker.Counts) bool) Option {
+	return func(c *Config) {
+		c.ReadyToTrip = fn
+	}
+}
+
+// WithOnStateChange sets the function called whenever the state of CircuitBreaker changes.
+func WithOnStateChange(fn func(name, from, to string)) Option {
+	return func(c *Config) {
+		c.OnStateChange = fn
+	}
+}
+
+// WithReconnectSleep sets the wait between attempts to connect, doubling after each failed attempt
+// from sleep up to max.
+func WithReconnectSleep(sleep, max time.Duration) Option {
+	return func(c *Config) {
+		c.ReconnectSleep = sleep
+		c.ReconnectMaxSleep = max
+	}
+}
+
+// WithOnReconnect sets the function called once the connection to the broker is recovered.
+func WithOnReconnect(fn func(attempt int)) Option {
+	return func(c *Config) {
+		c.OnReconnect = fn
+	}
+}
+
+// WithTLSConfig sets the TLS settings of amqps connections, e.g. with the client certificates for mutual TLS.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Config) {
+		c.TLSConfig = cfg
+	}
+}
+
+// WithMandatory publishes the messages as mandatory, calling fn with each of them returned by the broker
+// as unroutable.
+func WithMandatory(fn func(ret amqp.Return)) Option {
+	return func(c *Config) {
+		c.Mandatory = true
+		c.OnReturn = fn
+	}
+}
+
+// WithValidateRoutingKey rejects the messages to topic exchanges with a malformed routing key before publishing them.
+func WithValidateRoutingKey() Option {
+	return func(c *Config) {
+		c.ValidateRoutingKey = true
+	}
+}
+
+// WithExchangeAutoDelete declares the exchanges to be deleted by the broker once their last binding is removed.
+func WithExchangeAutoDelete() Option {
+	return func(c *Config) {
+		c.ExchangeAutoDelete = true
+	}
+}
+
+// WithSkipExchangeDeclare publishes without declaring the exchanges, assuming they exist.
+func WithSkipExchangeDeclare() Option {
+	return func(c *Config) {
+		c.SkipExchangeDeclare = true
+	}
+}
+
+// WithEmitResults reports the result of every message emitted asynchronously on EmitResults, along with the message.
+func WithEmitResults() Option {
+	return func(c *Config) {
+		c.EmitResults = true
+	}
+}
+
+// WithLogger sets the Logger of the reconnect attempts, the retried publishings and the CircuitBreaker state changes.
+func WithLogger(l Logger) Option {
+	return func(c *Config) {
+		c.Logger = l
+	}
+}
+
+// WithMetrics sets the MetricsObserver of the publishings and the CircuitBreaker state.
+func WithMetrics(m MetricsObserver) Option {
+	return func(c *Config) {
+		c.Metrics = m
+	}
+}
+
+// WithCloseTimeout sets how long Close waits for the messages already emitted to be published.
+func WithCloseTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.CloseTimeout = timeout
+	}
+}
+
+// WithConnectionName sets the name of the connections in the broker management UI.
+func WithConnectionName(name string) Option {
+	return func(c *Config) {
+		c.ConnectionName = name
+	}
+}
+
+// WithVhost sets the virtual host to connect to, overriding the one from the dsn.
+func WithVhost(vhost string) Option {
+	return func(c *Config) {
+		c.Vhost = vhost
+	}
+}
+
+// WithHeartbeat sets the interval of the heartbeats negotiated with the broker.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(c *Config) {
+		c.Heartbeat = interval
+	}
+}
+
+// WithConsumerBufferSize sets the buffer of the channels returned by Listen.
+func WithConsumerBufferSize(size int) Option {
+	return func(c *Config) {
+		c.ConsumerBufferSize = size
+	}
+}
+
+// WithCodec sets the codec marshaling the values emitted by EmitValue and EmitMessageValue without content-type.
+func WithCodec(codec Codec) Option {
+	return func(c *Config) {
+		c.Codec = codec
+	}
+}
+
+// WithEncoder sets the encoder of the values emitted by EmitValue.
+func WithEncoder(encoder Encoder) Option {
+	return func(c *Config) {
+		c.Encoder = encoder
+	}
+}
+
+// WithExchangeKinds sets the kind of each exchange, declaring those of the messages without Kind.
+func WithExchangeKinds(kinds map[string]string) Option {
+	return func(c *Config) {
+		c.ExchangeKinds = kinds
+	}
+}
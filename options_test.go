@@ -0,0 +1,54 @@
+package rabbus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+func TestConfigure(t *testing.T) {
+	c := configure("amqp://localhost:5672", nil)
+	if c.Dsn != "amqp://localhost:5672" || !c.Durable {
+		t.Fatalf("Expected durable config for the dsn by default, got %+v", c)
+	}
+
+	c = configure("amqp://localhost:5672", []Option{
+		WithDurable(false),
+		WithAttempts(3),
+		WithSleep(time.Second),
+		WithThreshold(10),
+		WithConnectionName("orders-api"),
+		WithVhost("orders"),
+		WithHeartbeat(3 * time.Second),
+		WithConsumerBufferSize(1024),
+	})
+	if c.Durable || c.Attempts != 3 || c.Sleep != time.Second || c.Threshold != 10 || c.ConnectionName != "orders-api" || c.Vhost != "orders" || c.Heartbeat != 3*time.Second || c.ConsumerBufferSize != 1024 {
+		t.Fatalf("Expected the options to be applied, got %+v", c)
+	}
+
+	c = configure("", []Option{withConfig(Config{Dsn: "amqp://localhost:5672", Attempts: 1})})
+	if c.Durable || c.Attempts != 1 {
+		t.Fatalf("Expected the config to be used as it is, got %+v", c)
+	}
+}
+
+func TestReadyToTrip(t *testing.T) {
+	trip := readyToTrip(Config{Threshold: 5})
+	if trip(gobreaker.Counts{ConsecutiveFailures: 5}) || !trip(gobreaker.Counts{ConsecutiveFailures: 6}) {
+		t.Error("Expected to trip once the consecutive failures exceed the threshold")
+	}
+
+	c := configure("amqp://localhost:5672", []Option{
+		WithReadyToTrip(func(counts gobreaker.Counts) bool {
+			return counts.Requests >= 10 && counts.TotalFailures*2 >= counts.Requests
+		}),
+	})
+	trip = readyToTrip(c)
+	if trip(gobreaker.Counts{Requests: 10, TotalFailures: 4, ConsecutiveFailures: 4}) {
+		t.Error("Expected not to trip below the failure ratio")
+	}
+	if !trip(gobreaker.Counts{Requests: 10, TotalFailures: 5, ConsecutiveFailures: 1}) {
+		t.Error("Expected to trip on the failure ratio")
+	}
+}
@@ -0,0 +1,131 @@
+package rabbus
+
+import (
+	"context"
+
+	"github.com/streadway/amqp"
+)
+
+// DeclareParkingQueue declares a durable queue holding dead-lettered messages for manual inspection.
+// The queue is declared again after every reconnect, point the dead-letter exchange of the
+// consuming queues to it through its bindings.
+func (r *rabbus) DeclareParkingQueue(queue string) error {
+	return r.DeclareTopology(Topology{
+		Queues: []Queue{{Name: queue, Durable: true}},
+	})
+}
+
+// QueueDepth returns the number of messages ready to be delivered from queue.
+func (r *rabbus) QueueDepth(queue string) (int, error) {
+	ch, err := r.openChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	q, err := ch.QueueInspect(r.name(queue))
+	if err != nil {
+		return 0, err
+	}
+
+	return q.Messages, nil
+}
+
+// Replay takes up to limit messages from parkingQueue and republishes them, with their body and properties,
+// to the destination they were originally published to, as recorded by the broker in the x-death header.
+// When targetExchange is not empty it is used instead of the original exchange, keeping the original
+// routing key, or else the routing key the message was parked with. A zero limit replays the messages
+// parked when Replay is called. Each message is acked once republished, the first failure requeues the message
+// and is returned. The messages without x-death, when targetExchange is empty, are skipped and requeued
+// once the others are replayed, ErrMissingDeathHeader is returned then.
+func (r *rabbus) Replay(parkingQueue, targetExchange string, limit int) error {
+	ch, err := r.openChannel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	queue := r.name(parkingQueue)
+	if limit <= 0 {
+		q, err := ch.QueueInspect(queue)
+		if err != nil {
+			return err
+		}
+		limit = q.Messages
+	}
+
+	// the skipped messages are held until the end, requeued right away they would be taken again.
+	var skipped []amqp.Delivery
+	defer func() {
+		for _, d := range skipped {
+			d.Nack(false, true)
+		}
+	}()
+
+	for i := 0; i < limit; i++ {
+		d, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			break
+		}
+
+		exchange, key, ok := deathOrigin(d.Headers)
+		if targetExchange != "" {
+			if !ok {
+				key = d.RoutingKey
+			}
+			exchange, ok = r.name(targetExchange), true
+		}
+
+		if !ok {
+			skipped = append(skipped, d)
+			continue
+		}
+
+		m := newConsumerMessage(d, nil)
+		pub := m.publishing()
+		if _, err := r.do(func(l *lane, done published) {
+			l.publish(context.Background(), exchange, key, false, pub, done)
+		}); err != nil {
+			d.Nack(false, true)
+			return err
+		}
+
+		if err := d.Ack(false); err != nil {
+			return err
+		}
+	}
+
+	if len(skipped) > 0 {
+		return ErrMissingDeathHeader
+	}
+
+	return nil
+}
+
+// deathOrigin returns the exchange and routing key a dead-lettered message was originally published to,
+// the broker records the most recent death first in x-death.
+func deathOrigin(headers amqp.Table) (string, string, bool) {
+	deaths, _ := headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return "", "", false
+	}
+
+	first, _ := deaths[len(deaths)-1].(amqp.Table)
+	exchange, ok := first["exchange"].(string)
+	if !ok {
+		return "", "", false
+	}
+
+	keys, _ := first["routing-keys"].([]interface{})
+	if len(keys) == 0 {
+		return "", "", false
+	}
+
+	key, ok := keys[0].(string)
+
+	return exchange, key, ok
+}
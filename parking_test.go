@@ -0,0 +1,122 @@
+package rabbus
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// parkingChannel holds the parked deliveries handed out by Get.
+type parkingChannel struct {
+	fakeChannel
+	parked []amqp.Delivery
+}
+
+func (ch *parkingChannel) QueueInspect(name string) (amqp.Queue, error) {
+	return amqp.Queue{Name: name, Messages: len(ch.parked)}, nil
+}
+
+func (ch *parkingChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	if len(ch.parked) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+
+	d := ch.parked[0]
+	ch.parked = ch.parked[1:]
+	return d, true, nil
+}
+
+func TestDeathOrigin(t *testing.T) {
+	death := func(exchange, key string) amqp.Table {
+		return amqp.Table{"exchange": exchange, "routing-keys": []interface{}{key}}
+	}
+
+	tests := []struct {
+		scenario string
+		headers  amqp.Table
+		exchange string
+		key      string
+		ok       bool
+	}{
+		{"missing header", amqp.Table{}, "", "", false},
+		{"nil headers", nil, "", "", false},
+		{"wrong header type", amqp.Table{"x-death": "orders"}, "", "", false},
+		{"wrong entry type", amqp.Table{"x-death": []interface{}{"orders"}}, "", "", false},
+		{"no deaths", amqp.Table{"x-death": []interface{}{}}, "", "", false},
+		{"single death", amqp.Table{"x-death": []interface{}{death("orders", "created")}}, "orders", "created", true},
+		{"multiple deaths", amqp.Table{"x-death": []interface{}{
+			death("orders_retry", "orders_q"),
+			death("orders", "created"),
+		}}, "orders", "created", true},
+		{"missing routing keys", amqp.Table{"x-death": []interface{}{amqp.Table{"exchange": "orders"}}}, "", "", false},
+		{"wrong exchange type", amqp.Table{"x-death": []interface{}{
+			amqp.Table{"exchange": 1, "routing-keys": []interface{}{"created"}},
+		}}, "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			exchange, key, ok := deathOrigin(test.headers)
+			if exchange != test.exchange || key != test.key || ok != test.ok {
+				t.Errorf("Expected %q %q %v, got %q %q %v", test.exchange, test.key, test.ok, exchange, key, ok)
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ack := &acknowledger{}
+	dead := amqp.Table{"x-death": []interface{}{amqp.Table{"exchange": "orders", "routing-keys": []interface{}{"created"}}}}
+	parking := &parkingChannel{parked: []amqp.Delivery{
+		{Acknowledger: ack, DeliveryTag: 1, Body: []byte("unknown")},
+		{Acknowledger: ack, DeliveryTag: 2, Headers: dead, Body: []byte("first")},
+		{Acknowledger: ack, DeliveryTag: 3, Headers: dead, Body: []byte("second")},
+	}}
+
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+	r.openChannel = func() (amqpChannel, error) { return parking, nil }
+	go r.register()
+	defer close(r.closed)
+
+	if n, err := r.QueueDepth("parking_q"); err != nil || n != 3 {
+		t.Fatalf("Expected 3 parked messages, got %d %v", n, err)
+	}
+
+	if err := r.Replay("parking_q", "", 0); err != ErrMissingDeathHeader {
+		t.Fatalf("Expected the message without x-death to be reported, got %v", err)
+	}
+
+	if len(ch.published) != 2 || ch.published[0].exchange != "orders" || ch.published[0].key != "created" || string(ch.published[1].pub.Body) != "second" {
+		t.Fatalf("Expected the parked messages after the unknown one republished to their origin, got %+v", ch.published)
+	}
+
+	if ack.acks != 3 || ack.last != "requeue" || ack.tag != 1 {
+		t.Fatalf("Expected the republished messages acked and the unknown one requeued at the end, got %+v", ack)
+	}
+}
+
+func TestReplayToTargetExchange(t *testing.T) {
+	ack := &acknowledger{}
+	parking := &parkingChannel{parked: []amqp.Delivery{
+		{Acknowledger: ack, DeliveryTag: 1, RoutingKey: "created", Body: []byte("unknown")},
+	}}
+
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+	r.openChannel = func() (amqpChannel, error) { return parking, nil }
+	go r.register()
+	defer close(r.closed)
+
+	if err := r.Replay("parking_q", "orders", 0); err != nil {
+		t.Fatalf("Expected the message to be replayed, got %v", err)
+	}
+
+	if len(ch.published) != 1 || ch.published[0].exchange != "orders" || ch.published[0].key != "created" {
+		t.Fatalf("Expected the message republished with the routing key it was parked with, got %+v", ch.published)
+	}
+
+	if ack.acks != 1 || ack.last != "ack" {
+		t.Fatalf("Expected the message to be acked, got %+v", ack)
+	}
+}
@@ -0,0 +1,1049 @@
+package rabbus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"github.com/streadway/amqp"
+)
+
+type publishing struct {
+	exchange, key string
+	pub           amqp.Publishing
+}
+
+// fakeChannel records what is published and declared on it, failing the first
+// failPublish publishings, the ones beyond limit when set, and nacking the first nack ones in confirm mode.
+type fakeChannel struct {
+	published   []publishing
+	declared    []string
+	checked     []string
+	autoDeleted []string
+	bound       []string
+	queueBound  []string
+	unbound     []string
+	failPublish int
+	limit       int
+	failDeclare error
+	nack        int
+	confirms    chan amqp.Confirmation
+	tag         uint64
+}
+
+func (f *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if f.failPublish > 0 {
+		f.failPublish--
+		return errors.New("publish failed")
+	}
+
+	if f.limit > 0 && len(f.published) == f.limit {
+		return errors.New("publish failed")
+	}
+
+	f.published = append(f.published, publishing{exchange, key, msg})
+
+	if f.confirms != nil {
+		f.tag++
+		f.confirms <- amqp.Confirmation{DeliveryTag: f.tag, Ack: f.nack == 0}
+		if f.nack > 0 {
+			f.nack--
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	if f.failDeclare != nil {
+		return f.failDeclare
+	}
+
+	f.declared = append(f.declared, name)
+	if autoDelete {
+		f.autoDeleted = append(f.autoDeleted, name)
+	}
+	return nil
+}
+
+func (f *fakeChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	if f.failDeclare != nil {
+		return f.failDeclare
+	}
+
+	f.checked = append(f.checked, name)
+	return nil
+}
+
+func (f *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+func (f *fakeChannel) QueueInspect(name string) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+func (f *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	f.queueBound = append(f.queueBound, exchange+"->"+name)
+	return nil
+}
+
+func (f *fakeChannel) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	f.unbound = append(f.unbound, exchange+"->"+name)
+	return nil
+}
+
+func (f *fakeChannel) ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error {
+	f.bound = append(f.bound, source+"->"+destination)
+	return nil
+}
+
+func (f *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return make(chan amqp.Delivery), nil
+}
+
+func (f *fakeChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	return amqp.Delivery{}, false, nil
+}
+
+func (f *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error { return nil }
+
+func (f *fakeChannel) Confirm(noWait bool) error { return nil }
+
+func (f *fakeChannel) NotifyPublish(c chan amqp.Confirmation) chan amqp.Confirmation {
+	f.confirms = c
+	return c
+}
+
+func (f *fakeChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return { return c }
+
+func (f *fakeChannel) Close() error { return nil }
+
+// newTestRabbus returns the single lane of a rabbus publishing on ch, the rabbus is embedded in it.
+func newTestRabbus(ch amqpChannel, c Config) *lane {
+	r := &rabbus{
+		breaker:  gobreaker.NewCircuitBreaker(gobreaker.Settings{}),
+		config:   c,
+		requests: make(chan func(l *lane)),
+		closed:   make(chan struct{}),
+	}
+
+	l := newLane(r, ch)
+	r.lanes = []*lane{l}
+
+	return l
+}
+
+func TestSendAppliesDefaults(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+
+	var err error
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key", Payload: []byte(`{}`)}, true, func(_ Receipt, e error) { err = e })
+	if err != nil {
+		t.Fatalf("Expected to send message %s", err)
+	}
+
+	pub := ch.published[0].pub
+	if pub.ContentType != ContentTypeJSON || pub.DeliveryMode != Persistent {
+		t.Fatalf("Expected JSON persistent message, got %s %d", pub.ContentType, pub.DeliveryMode)
+	}
+}
+
+func TestSendValidatesAfterBeforePublish(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1, BeforePublish: func(m *Message) error {
+		if m.Kind == "" {
+			m.Kind = "topic"
+		}
+		if m.Key == "invalid" {
+			m.DeliveryMode = 3
+		}
+		return nil
+	}})
+
+	var err error
+	r.send(context.Background(), Message{Exchange: "test_ex", Key: "test_key"}, true, func(_ Receipt, e error) { err = e })
+	if err != nil || len(ch.published) != 1 {
+		t.Fatalf("Expected the kind filled in by the hook to be used, got %v", err)
+	}
+
+	r.send(context.Background(), Message{Exchange: "test_ex", Key: "invalid"}, true, func(_ Receipt, e error) { err = e })
+	if err != ErrInvalidDeliveryMode || len(ch.published) != 1 {
+		t.Fatalf("Expected the delivery mode set by the hook to be refused, got %v", err)
+	}
+}
+
+func TestSendDeclaresExchangeOnce(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+
+	for i := 0; i < 3; i++ {
+		r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}, true, func(Receipt, error) {})
+	}
+
+	if len(ch.declared) != 1 || len(ch.published) != 3 {
+		t.Fatalf("Expected 1 declare and 3 publishings, got %d and %d", len(ch.declared), len(ch.published))
+	}
+}
+
+func TestSendDeclaresAutoDeleteExchange(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1, ExchangeAutoDelete: true})
+
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}, true, func(Receipt, error) {})
+
+	if len(ch.autoDeleted) != 1 || ch.autoDeleted[0] != "test_ex" {
+		t.Fatalf("Expected the exchange to be declared auto-delete, got %v", ch.autoDeleted)
+	}
+}
+
+func TestSendSkipsExchangeDeclare(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1, SkipExchangeDeclare: true})
+
+	var err error
+	r.send(context.Background(), Message{Exchange: "test_ex", Key: "test_key"}, true, func(_ Receipt, e error) { err = e })
+
+	if err != nil || len(ch.published) != 1 {
+		t.Fatalf("Expected to publish without a kind, got %v", err)
+	}
+	if len(ch.declared) != 0 || len(ch.checked) != 0 {
+		t.Fatalf("Expected the exchange not to be declared, got %v and %v", ch.declared, ch.checked)
+	}
+}
+
+func TestSendChecksPassiveExchange(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1, PassiveExchanges: true})
+
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}, true, func(Receipt, error) {})
+
+	if len(ch.checked) != 1 || len(ch.declared) != 0 {
+		t.Fatalf("Expected the exchange to be checked rather than declared, got %v and %v", ch.checked, ch.declared)
+	}
+
+	missing := &amqp.Error{Code: amqp.NotFound}
+	ch = &fakeChannel{failDeclare: missing}
+	r = newTestRabbus(ch, Config{Attempts: 3, PassiveExchanges: true})
+	r.openChannel = func() (amqpChannel, error) { return ch, nil }
+
+	var err error
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}, true, func(_ Receipt, e error) { err = e })
+
+	if err != missing || len(ch.published) != 0 {
+		t.Fatalf("Expected to fail fast with %v without publishing, got %v", missing, err)
+	}
+}
+
+func TestSendDeclaresExchangeOnNewChannel(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *amqp.Error
+		sent bool
+	}{
+		{"transient", &amqp.Error{Code: amqp.ChannelError}, true},
+		{"permanent", &amqp.Error{Code: amqp.PreconditionFailed}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := &fakeChannel{failDeclare: tt.err}
+			ch := &fakeChannel{}
+			r := newTestRabbus(old, Config{Attempts: 2})
+			r.openChannel = func() (amqpChannel, error) { return ch, nil }
+
+			var err error
+			r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}, true, func(_ Receipt, e error) { err = e })
+			if (err == nil) != tt.sent {
+				t.Fatalf("Expected the message to be sent: %t, got %v", tt.sent, err)
+			}
+
+			if r.ch != ch {
+				t.Fatal("Expected the producer channel closed by the broker to be replaced")
+			}
+			if tt.sent && (len(ch.declared) != 1 || len(ch.published) != 1) {
+				t.Fatalf("Expected the retry on the new channel, got %d declares and %d publishings", len(ch.declared), len(ch.published))
+			}
+			if !tt.sent && len(ch.declared) != 0 {
+				t.Fatalf("Expected no retry after a permanent error, got %d declares", len(ch.declared))
+			}
+		})
+	}
+}
+
+func TestSendRetriesPublishing(t *testing.T) {
+	ch := &fakeChannel{failPublish: 1}
+	r := newTestRabbus(ch, Config{Attempts: 2})
+
+	var err error
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}, true, func(_ Receipt, e error) { err = e })
+	if err != nil || len(ch.published) != 1 {
+		t.Fatalf("Expected the message to be published on retry, got %v", err)
+	}
+}
+
+func TestSendRetriesNackedMessages(t *testing.T) {
+	ch := &fakeChannel{nack: 1}
+	r := newTestRabbus(ch, Config{Attempts: 2, EnablePublisherConfirms: true})
+	r.trackConfirms(ch)
+
+	var (
+		receipt Receipt
+		err     error
+	)
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}, true, func(r Receipt, e error) { receipt, err = r, e })
+	if err != nil {
+		t.Fatalf("Expected the nacked message to be published again, got %v", err)
+	}
+
+	if len(ch.published) != 2 || receipt.Tag != 2 {
+		t.Fatalf("Expected the message to be confirmed on the second publishing, got tag %d", receipt.Tag)
+	}
+
+	ch.nack = 2
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}, true, func(r Receipt, e error) { receipt, err = r, e })
+	if err != ErrNacked {
+		t.Fatalf("Expected %v, got %v", ErrNacked, err)
+	}
+}
+
+func TestEmitSyncReportsEachResult(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+	go r.register()
+	defer close(r.closed)
+
+	errs := make(chan error, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		m := Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}
+		if i%2 == 0 {
+			m.Kind = ""
+		}
+
+		wg.Add(1)
+		go func(m Message) {
+			defer wg.Done()
+			err := r.EmitSync(m)
+			if (m.Kind == "") != (err == ErrMissingKind) {
+				errs <- err
+			}
+		}(m)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Expected each caller to get its own result, got %v", err)
+	}
+
+	if len(ch.published) != 5 {
+		t.Fatalf("Expected 5 messages to be published, got %d", len(ch.published))
+	}
+}
+
+func TestEmitSyncWithContextCancelled(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+	go r.register()
+	defer close(r.closed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := r.EmitSyncWithContext(ctx, Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"})
+	if err != context.Canceled {
+		t.Fatalf("Expected %v, got %v", context.Canceled, err)
+	}
+
+	if len(ch.published) != 0 {
+		t.Fatalf("Expected a cancelled message not to be published, got %d", len(ch.published))
+	}
+}
+
+func TestSendHeaders(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+
+	headers := amqp.Table{"x-request-id": "42"}
+	m := Message{Exchange: "test_ex", Kind: "direct", Key: "test_key", Headers: headers}
+	r.send(context.Background(), m, true, func(Receipt, error) {})
+
+	m.idempotencyKey = "key"
+	r.send(context.Background(), m, true, func(Receipt, error) {})
+
+	if got := ch.published[0].pub.Headers; got["x-request-id"] != "42" || len(got) != 1 {
+		t.Fatalf("Expected the headers to pass through, got %v", got)
+	}
+
+	if got := ch.published[1].pub.Headers; got["x-request-id"] != "42" || got[IdempotencyKeyHeader] != "key" {
+		t.Fatalf("Expected the headers along with the idempotency key, got %v", got)
+	}
+
+	if len(headers) != 1 {
+		t.Fatalf("Expected the message headers to be left untouched, got %v", headers)
+	}
+}
+
+func TestSendDelay(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+
+	headers := amqp.Table{"x-request-id": "42"}
+	m := Message{Exchange: "test_ex", Kind: ExchangeDelayed, Key: "test_key", Headers: headers, Delay: 1500 * time.Millisecond}
+	r.send(context.Background(), m, true, func(Receipt, error) {})
+
+	if got := ch.published[0].pub.Headers; got[DelayHeader] != int64(1500) || got["x-request-id"] != "42" {
+		t.Fatalf("Expected the delay in milliseconds along with the headers, got %v", got)
+	}
+
+	if len(headers) != 1 {
+		t.Fatalf("Expected the message headers to be left untouched, got %v", headers)
+	}
+
+	if args := exchangeArgs(ExchangeDelayed); args["x-delayed-type"] != "direct" {
+		t.Errorf("Expected the delayed exchange to route like a direct one, got %v", args)
+	}
+
+	if args := exchangeArgs("direct"); args != nil {
+		t.Errorf("Expected no arguments for other exchanges, got %v", args)
+	}
+}
+
+func TestSendPriority(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key", Priority: 7}, true, func(Receipt, error) {})
+	if got := ch.published[0].pub.Priority; got != 7 {
+		t.Fatalf("Expected priority 7, got %d", got)
+	}
+}
+
+func TestSendMessageIdAndTimestamp(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+
+	created := time.Date(2017, 6, 24, 12, 0, 0, 0, time.UTC)
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key", MessageId: "order-1", Timestamp: created}, true, func(Receipt, error) {})
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}, true, func(Receipt, error) {})
+
+	if got := ch.published[0].pub; got.MessageId != "order-1" || !got.Timestamp.Equal(created) {
+		t.Errorf("Expected the message id and timestamp to be set, got %q %s", got.MessageId, got.Timestamp)
+	}
+
+	if got := ch.published[1].pub; got.MessageId != "" || got.Timestamp.IsZero() {
+		t.Errorf("Expected no message id and the publishing time, got %q %s", got.MessageId, got.Timestamp)
+	}
+}
+
+func TestEmitAfterClose(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1})
+	r.emit = make(chan Message)
+	go r.register()
+	r.shutdown(time.Second)
+
+	m := Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}
+	if err := r.TryEmit(m); err != ErrClosed {
+		t.Errorf("Expected TryEmit to fail with %v, got %v", ErrClosed, err)
+	}
+
+	if err := r.EmitMessageValue(m, map[string]string{"foo": "bar"}); err != ErrClosed {
+		t.Errorf("Expected EmitMessageValue to fail with %v, got %v", ErrClosed, err)
+	}
+
+	if err := r.EmitSharded(m, "key", 4); err != ErrClosed {
+		t.Errorf("Expected EmitSharded to fail with %v, got %v", ErrClosed, err)
+	}
+
+	if err := r.EmitSync(m); err != ErrClosed {
+		t.Errorf("Expected EmitSync to fail with %v, got %v", ErrClosed, err)
+	}
+}
+
+func TestEmitAsyncWhileClosing(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+	r.emit = make(chan Message)
+	r.emitErr = make(chan error)
+	r.emitOk = make(chan struct{})
+	go r.register()
+
+	m := Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}
+	stop := make(chan struct{})
+	sending := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-r.emitOk:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer close(sending)
+		for {
+			select {
+			case r.EmitAsync() <- m:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	r.shutdown(time.Second)
+
+	select {
+	case err := <-r.EmitErr():
+		if err != ErrClosed {
+			t.Fatalf("Expected the messages sent once closed to fail with %v, got %v", ErrClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected EmitAsync to keep accepting messages once closed")
+	}
+
+	close(stop)
+	<-sending
+}
+
+func TestEmitResults(t *testing.T) {
+	ch := &fakeChannel{failPublish: 1}
+	r := newTestRabbus(ch, Config{Attempts: 1, EmitResults: true})
+	r.emit = make(chan Message)
+	r.results = make(chan EmitResult, 2)
+	// the producer channel was renewed on the connection of the second generation.
+	r.connGeneration = 2
+	go r.register()
+	defer close(r.closed)
+
+	for _, id := range []string{"1", "2"} {
+		if err := r.TryEmit(Message{Exchange: "test_ex", Kind: "direct", Key: "test_key", MessageId: id}); err != nil {
+			t.Fatalf("Expected the message to be accepted, got %v", err)
+		}
+	}
+
+	if res := <-r.EmitResults(); res.Message.MessageId != "1" || res.Err == nil || res.Receipt != (Receipt{}) {
+		t.Errorf("Expected the first message to fail, got %+v", res)
+	}
+
+	if res := <-r.EmitResults(); res.Message.MessageId != "2" || res.Err != nil || res.Receipt.Generation != 2 {
+		t.Errorf("Expected the second message to be sent on the second generation, got %+v", res)
+	}
+}
+
+func TestEmitConfirmReceipt(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1, EnablePublisherConfirms: true})
+	r.trackConfirms(ch)
+	r.openChannel = func() (amqpChannel, error) { return &fakeChannel{}, nil }
+	go r.register()
+	defer close(r.closed)
+
+	m := Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}
+	first, err := r.EmitConfirm(m)
+	if err != nil {
+		t.Fatalf("Expected the message to be confirmed, got %v", err)
+	}
+
+	// the tags start over on the recovered channel.
+	if err := r.Recover(); err != nil {
+		t.Fatalf("Expected to recover the producer channel, got %v", err)
+	}
+
+	second, err := r.EmitConfirm(m)
+	if err != nil {
+		t.Fatalf("Expected the message to be confirmed, got %v", err)
+	}
+
+	if first.Tag != 1 || second.Tag != 1 || first.Epoch == second.Epoch {
+		t.Fatalf("Expected the same tag on different epochs, got %+v and %+v", first, second)
+	}
+}
+
+func TestEmitRaw(t *testing.T) {
+	ch := &fakeChannel{}
+	hooked := false
+	r := newTestRabbus(ch, Config{Attempts: 1, ExchangeKinds: map[string]string{"test_ex": "direct"}, BeforePublish: func(*Message) error {
+		hooked = true
+		return nil
+	}})
+	go r.register()
+	defer close(r.closed)
+
+	pub := amqp.Publishing{ContentType: "text/plain", Body: []byte("raw")}
+	for i := 0; i < 2; i++ {
+		if err := r.EmitRaw("test_ex", "test_key", pub); err != nil {
+			t.Fatalf("Expected to publish the raw message, got %v", err)
+		}
+	}
+
+	if err := r.EmitRaw("other_ex", "test_key", pub); err != ErrMissingKind {
+		t.Fatalf("Expected the exchange without kind to fail with %v, got %v", ErrMissingKind, err)
+	}
+
+	if len(ch.declared) != 1 || ch.declared[0] != "test_ex" {
+		t.Fatalf("Expected the exchange to be declared once, got %v", ch.declared)
+	}
+
+	if len(ch.published) != 2 {
+		t.Fatalf("Expected 2 publishings, got %d", len(ch.published))
+	}
+
+	p := ch.published[0].pub
+	if p.ContentType != "text/plain" || p.DeliveryMode != 0 || string(p.Body) != "raw" {
+		t.Fatalf("Expected the publishing to be sent as it is, got %+v", p)
+	}
+
+	if hooked {
+		t.Fatal("Expected BeforePublish not to be called for raw publishings")
+	}
+}
+
+func TestEmitRawSkipsDeclaredExchange(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1, ExchangeKinds: map[string]string{"test_ex": "direct"}})
+	go r.register()
+	defer close(r.closed)
+
+	durable := false
+	m := Message{Exchange: "test_ex", Key: "test_key", ExchangeDurable: &durable}
+	if err := r.EmitSync(m); err != nil {
+		t.Fatalf("Expected to publish the message, got %v", err)
+	}
+
+	if err := r.EmitRaw("test_ex", "test_key", amqp.Publishing{Body: []byte("raw")}); err != nil {
+		t.Fatalf("Expected to publish the raw message, got %v", err)
+	}
+
+	if len(ch.declared) != 1 || len(ch.published) != 2 {
+		t.Fatalf("Expected the exchange declared once and 2 publishings, got %v and %d", ch.declared, len(ch.published))
+	}
+}
+
+func TestEmitRawSkipExchangeDeclare(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1, SkipExchangeDeclare: true})
+	go r.register()
+	defer close(r.closed)
+
+	if err := r.EmitRaw("test_ex", "test_key", amqp.Publishing{Body: []byte("raw")}); err != nil {
+		t.Fatalf("Expected to publish the raw message, got %v", err)
+	}
+
+	if len(ch.declared) != 0 || len(ch.published) != 1 {
+		t.Fatalf("Expected no exchange declared and 1 publishing, got %v and %d", ch.declared, len(ch.published))
+	}
+}
+
+func TestForward(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1, NamePrefix: "app_"})
+	go r.register()
+	defer close(r.closed)
+
+	msg := newConsumerMessage(amqp.Delivery{
+		Exchange:    "test_ex",
+		RoutingKey:  "test_key",
+		ContentType: ContentTypeJSON,
+		MessageId:   "42",
+		Headers:     amqp.Table{"x-tenant": "acme"},
+		Body:        []byte(`{"id":42}`),
+	}, nil)
+
+	if err := r.Forward(msg, "audit_ex", "audit_key"); err != nil {
+		t.Fatalf("Expected to forward the message, got %v", err)
+	}
+
+	if len(ch.published) != 1 {
+		t.Fatalf("Expected the message to be published once, got %d", len(ch.published))
+	}
+
+	p := ch.published[0]
+	if p.exchange != "app_audit_ex" || p.key != "audit_key" {
+		t.Fatalf("Expected the message forwarded to app_audit_ex with audit_key, got %s %s", p.exchange, p.key)
+	}
+
+	if string(p.pub.Body) != `{"id":42}` || p.pub.MessageId != "42" || p.pub.ContentType != ContentTypeJSON || p.pub.Headers["x-tenant"] != "acme" {
+		t.Fatalf("Expected the message forwarded unchanged, got %+v", p.pub)
+	}
+
+	if len(ch.declared) != 0 {
+		t.Fatalf("Expected the exchange not to be declared, got %v", ch.declared)
+	}
+}
+
+// stuckChannel blocks declaring an exchange until released, then fails like a broker closing the channel.
+type stuckChannel struct {
+	fakeChannel
+	declaring chan struct{}
+	release   chan struct{}
+}
+
+func (s *stuckChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	close(s.declaring)
+	<-s.release
+	return &amqp.Error{Code: amqp.ChannelError}
+}
+
+func TestCloseProducersAfterTimeout(t *testing.T) {
+	ch := &stuckChannel{declaring: make(chan struct{}), release: make(chan struct{})}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+	r.openChannel = func() (amqpChannel, error) { return &fakeChannel{}, nil }
+	go r.register()
+
+	go r.EmitSync(Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"})
+	<-ch.declaring
+
+	r.shutdown(10 * time.Millisecond)
+
+	// the register goroutine swaps its channel while the producer channels are closed.
+	close(ch.release)
+	if err := r.closeProducers(); err != nil {
+		t.Fatalf("Expected to close the producer channels, got %v", err)
+	}
+	<-r.drained
+}
+
+func TestShutdownWithUnreadResults(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1})
+	r.emit = make(chan Message)
+	r.emitOk = make(chan struct{})
+	go r.register()
+
+	// nobody reads EmitOk, the register goroutine waits to report the result.
+	if err := r.TryEmit(Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}); err != nil {
+		t.Fatalf("Expected the message to be accepted, got %v", err)
+	}
+
+	go r.shutdown(time.Minute)
+
+	select {
+	case <-r.drained:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the register goroutine to return once closed")
+	}
+}
+
+func TestShutdownPublishesEmittedMessages(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+	r.emit = make(chan Message)
+	r.emitOk = make(chan struct{}, 10)
+	go r.register()
+
+	// the register goroutine is kept busy while messages are emitted and rabbus is closed.
+	hold := make(chan struct{})
+	r.requests <- func(*lane) { <-hold }
+
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			errs <- r.TryEmit(Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"})
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	shutdown := make(chan struct{})
+	go func() {
+		r.shutdown(time.Second)
+		close(shutdown)
+	}()
+	close(hold)
+
+	select {
+	case <-shutdown:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected shutdown to return")
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Expected the messages emitted before closing to be accepted, got %v", err)
+		}
+	}
+
+	if len(ch.published) != 10 {
+		t.Fatalf("Expected the emitted messages to be published, got %d", len(ch.published))
+	}
+}
+
+func TestRenewProducer(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1})
+	go r.register()
+	defer r.shutdown(time.Second)
+
+	recovered := &fakeChannel{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.EmitSync(Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"})
+		}()
+	}
+
+	r.renewProducer(recovered, 1)
+	wg.Wait()
+
+	if err := r.EmitSync(Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}); err != nil {
+		t.Fatalf("Expected to publish on the new channel, got %v", err)
+	}
+
+	if len(recovered.declared) != 1 {
+		t.Fatalf("Expected the exchange to be declared again on the new channel, got %v", recovered.declared)
+	}
+}
+
+func TestRenewProducerWithUnreadResults(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1})
+	r.emit = make(chan Message)
+	r.emitOk = make(chan struct{})
+	go r.register()
+	defer r.shutdown(time.Second)
+
+	// nobody reads EmitOk yet, the register goroutine waits to report the result.
+	m := Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}
+	if err := r.TryEmit(m); err != nil {
+		t.Fatalf("Expected the message to be accepted, got %v", err)
+	}
+
+	recovered := &fakeChannel{}
+	renewed := make(chan struct{})
+	go func() {
+		r.renewProducer(recovered, 1)
+		close(renewed)
+	}()
+
+	select {
+	case <-renewed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the reconnect not to wait for the results to be read")
+	}
+
+	<-r.emitOk
+	if err := r.EmitSync(m); err != nil {
+		t.Fatalf("Expected to publish on the new channel, got %v", err)
+	}
+
+	if len(recovered.published) != 1 {
+		t.Fatalf("Expected the next publishing on the new channel, got %d", len(recovered.published))
+	}
+}
+
+func TestEmitWhileReconnecting(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1, ConfirmBatchWindow: time.Millisecond})
+	r.trackConfirms(r.ch)
+	go r.register()
+	defer r.shutdown(time.Second)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				err := r.EmitSync(Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"})
+				if err != nil && err != ErrConnectionClosed {
+					t.Errorf("Expected the message to be published or lost along with the connection, got %v", err)
+				}
+				r.EmitBatch(testBatch(2))
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		r.renewProducer(&fakeChannel{}, 1)
+		if i%5 == 0 {
+			r.IsConnected()
+			r.Generation()
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestCircuitState(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	r.breaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		ReadyToTrip: func(gobreaker.Counts) bool { return true },
+	})
+
+	if s := r.CircuitState(); s != "closed" {
+		t.Errorf("Expected the circuit to be closed, got %s", s)
+	}
+
+	r.breaker.Execute(func() (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+
+	if s := r.CircuitState(); s != "open" {
+		t.Errorf("Expected the circuit to be open, got %s", s)
+	}
+}
+
+func TestSendCriticalWithCircuitOpen(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+	r.breaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		ReadyToTrip: func(gobreaker.Counts) bool { return true },
+		Timeout:     time.Hour,
+	})
+	r.breaker.Execute(func() (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+
+	var err error
+	m := Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}
+	r.send(context.Background(), m, true, func(_ Receipt, e error) { err = e })
+	if err != ErrCircuitOpen || len(ch.published) != 0 {
+		t.Fatalf("Expected the message to be refused with the circuit open, got %v", err)
+	}
+
+	m.Critical = true
+	r.send(context.Background(), m, true, func(_ Receipt, e error) { err = e })
+	if err != nil || len(ch.published) != 1 {
+		t.Fatalf("Expected the critical message to be published with the circuit open, got %v", err)
+	}
+
+	if s := r.CircuitState(); s != "open" {
+		t.Errorf("Expected the circuit to stay open, got %s", s)
+	}
+}
+
+func TestLanesPublishInParallel(t *testing.T) {
+	first := newTestRabbus(&fakeChannel{}, Config{Attempts: 1})
+	ch := &fakeChannel{}
+	second := newLane(first.rabbus, ch)
+	first.lanes = append(first.lanes, second)
+	for _, l := range first.lanes {
+		go l.register()
+	}
+	defer close(first.closed)
+
+	// the first lane is kept busy, the messages are published by the second one meanwhile.
+	hold := make(chan struct{})
+	defer close(hold)
+	first.tasks <- func(*lane) { <-hold }
+
+	for i := 0; i < 3; i++ {
+		if err := first.EmitSync(Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}); err != nil {
+			t.Fatalf("Expected to emit the message %s", err)
+		}
+	}
+
+	if len(ch.published) != 3 {
+		t.Fatalf("Expected the messages to be published on the second channel, got %d", len(ch.published))
+	}
+}
+
+func TestRecoverProducerStartsNewEpoch(t *testing.T) {
+	recovered := &fakeChannel{}
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1})
+	r.openChannel = func() (amqpChannel, error) { return recovered, nil }
+
+	if err := r.recoverProducer(); err != nil {
+		t.Fatalf("Expected to recover the producer channel, got %v", err)
+	}
+
+	if r.ch != recovered || r.epoch != 1 {
+		t.Fatalf("Expected the recovered channel to start a new epoch, got %d", r.epoch)
+	}
+}
+
+func TestRenewProducers(t *testing.T) {
+	first := newTestRabbus(&fakeChannel{}, Config{Attempts: 1})
+	second := newLane(first.rabbus, &fakeChannel{})
+	first.lanes = append(first.lanes, second)
+	for _, l := range first.lanes {
+		go l.register()
+	}
+	defer close(first.closed)
+
+	chs := []amqpChannel{&fakeChannel{}, &fakeChannel{}}
+	first.renewProducers(chs, 1)
+
+	for i, l := range first.lanes {
+		if _, err := first.request(context.Background(), l.tasks, func(l *lane, done published) {
+			if l.ch != chs[i] || l.connGeneration != 1 || l.epoch != 1 {
+				t.Errorf("Expected lane %d to publish on its new channel, got generation %d and epoch %d", i, l.connGeneration, l.epoch)
+			}
+			done(Receipt{}, nil)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRetryAttemptsBackoff(t *testing.T) {
+	var waits []int
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 3, RetryBackoff: func(attempt int) time.Duration {
+		waits = append(waits, attempt)
+		return 0
+	}})
+
+	var attempts []int
+	err := r.retryAttempts(func(attempt int) error {
+		attempts = append(attempts, attempt)
+		return errors.New("failed")
+	})
+	if err == nil {
+		t.Fatal("Expected the last error once the attempts are exhausted")
+	}
+
+	if len(attempts) != 3 || attempts[2] != 3 {
+		t.Errorf("Expected 3 numbered attempts, got %v", attempts)
+	}
+
+	if len(waits) != 2 || waits[0] != 1 || waits[1] != 2 {
+		t.Errorf("Expected to wait after each failed attempt but the last, got %v", waits)
+	}
+}
+
+func TestBreakerCountsAttempts(t *testing.T) {
+	ch := &fakeChannel{failPublish: 10}
+	r := newTestRabbus(ch, Config{Attempts: 5})
+	r.breaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{ReadyToTrip: readyToTrip(Config{Threshold: 2})})
+
+	var err error
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}, true, func(_ Receipt, e error) { err = e })
+
+	if r.CircuitState() != "open" {
+		t.Fatalf("Expected a single message failing 3 attempts to open the circuit, got %s", r.CircuitState())
+	}
+
+	if err != ErrCircuitOpen {
+		t.Errorf("Expected %v once the circuit opened, got %v", ErrCircuitOpen, err)
+	}
+
+	if ch.failPublish != 7 {
+		t.Errorf("Expected the attempts to be given up once the circuit opened, got %d attempts", 10-ch.failPublish)
+	}
+}
+
+func TestBreakerCountsRetriedSuccess(t *testing.T) {
+	ch := &fakeChannel{failPublish: 2}
+	r := newTestRabbus(ch, Config{Attempts: 3})
+
+	var err error
+	r.send(context.Background(), Message{Exchange: "test_ex", Kind: "direct", Key: "test_key"}, true, func(_ Receipt, e error) { err = e })
+	if err != nil {
+		t.Fatalf("Expected the message to be published on the last attempt, got %v", err)
+	}
+
+	if c := r.breaker.Counts(); c.TotalFailures != 2 || c.TotalSuccesses != 1 {
+		t.Errorf("Expected the breaker to count every attempt, got %+v", c)
+	}
+}
@@ -1,6 +1,8 @@
 package rabbus
 
 import (
+	"context"
+	"crypto/tls"
 	"sync"
 	"time"
 
@@ -23,29 +25,131 @@ const (
 // Rabbus exposes a interface for emitting and listening for messages.
 type Rabbus interface {
 	// EmitAsync emits a message to RabbitMQ, but does not wait for the response from broker.
+	// The messages sent once closed are answered with ErrClosed on EmitErr, or EmitResults, when read.
 	EmitAsync() chan<- Message
+	// TryEmit emits a message asynchronously like EmitAsync, but returns ErrCircuitOpen right away
+	// when the circuit breaker is open instead of queueing a message bound to fail, and ErrClosed once closed.
+	TryEmit(m Message) error
+	// EmitValue encodes v with Config.Encoder into the payload of a message to exchange with the routing
+	// key key, setting its content-type, and emits the message asynchronously. The exchange is declared
+	// with its kind from Config.ExchangeKinds. Returns an error if encoding fails.
+	EmitValue(exchange, key string, v interface{}) error
+	// EmitMessageValue marshals v into the message payload using the codec matching the message content-type,
+	// or Config.Encoder when it is empty, and emits the message asynchronously. Returns an error
+	// if there is no codec for the content-type or if marshalling fails.
+	EmitMessageValue(m Message, v interface{}) error
+	// EmitIdempotent publishes a message carrying the idempotency key key and waits for the result,
+	// including the broker confirm when Config.EnablePublisherConfirms or Config.ConfirmBatchWindow is set.
+	// Returns an error if after circuit breaker is open, retries attempts exceed or ErrNacked if the broker
+	// nacked the message.
+	EmitIdempotent(m Message, key string) error
+	// EmitSharded emits a message asynchronously with the routing key "shard.<n>", n being picked
+	// from shardKey among shards, returns ErrInvalidShards if shards is not positive.
+	EmitSharded(m Message, shardKey string, shards int) error
 	// EmitErr returns an error if encoding payload fails, or if after circuit breaker is open or retries attempts exceed.
 	EmitErr() <-chan error
 	// EmitOk returns true when the message was sent.
 	EmitOk() <-chan struct{}
+	// EmitResults returns the result of every message emitted asynchronously, along with the message,
+	// when Config.EmitResults is set.
+	EmitResults() <-chan EmitResult
+	// EmitSync publishes a message and waits for the result, returns an error if after circuit breaker
+	// is open or retries attempts exceed.
+	EmitSync(m Message) error
+	// EmitSyncWithContext is like EmitSync but gives up once ctx is done, returning ctx.Err().
+	EmitSyncWithContext(ctx context.Context, m Message) error
+	// EmitNoDeclare publishes a message assuming its exchange already exists and waits for the result.
+	// Returns an error if after circuit breaker is open or retries attempts exceed.
+	EmitNoDeclare(m Message) error
+	// EmitRaw publishes an amqp.Publishing as it is and waits for the result, declaring the exchange with
+	// its kind from Config.ExchangeKinds and Config.Durable when it was not declared yet. Returns ErrMissingKind
+	// if the exchange has no kind, or an error if after circuit breaker is open or retries attempts exceed.
+	EmitRaw(exchange, key string, pub amqp.Publishing) error
+	// Forward republishes a consumed message to exchange with the routing key key, preserving its body
+	// and properties, and waits for the result. Returns an error if after circuit breaker is open or retries attempts exceed.
+	Forward(msg ConsumerMessage, exchange, key string) error
+	// EmitBatch publishes messages in order within a single circuit breaker execution and waits for all
+	// of them, returns a *BatchError telling how many were published if any of them fails.
+	EmitBatch(msgs []Message) error
+	// EmitConfirm emits a message and waits for the broker to confirm it, returning the receipt of its
+	// delivery tag, returns ErrConfirmsDisabled if publisher confirms are not enabled.
+	EmitConfirm(m Message) (Receipt, error)
 	// Listen to a message from RabbitMQ, returns
 	// an error if exchange, queue name and function handler not passed or if an error occurred while creating
 	// amqp consumer.
 	Listen(ListenConfig) (chan ConsumerMessage, error)
-	// Close attempt to close channel and connection.
-	Close()
+	// ListenWithContext listens like Listen until ctx is done, then cancels the consumer and closes
+	// the returned channel.
+	ListenWithContext(ctx context.Context, c ListenConfig) (chan ConsumerMessage, error)
+	// ListenWithCancel listens like Listen and returns a Listener to stop consuming, closing the channel,
+	// or to unbind the queue at runtime.
+	ListenWithCancel(c ListenConfig) (chan ConsumerMessage, *Listener, error)
+	// TryListen validates the ListenConfig and sets up the consumer in the background like Listen,
+	// reporting the setup result, nil once ready, on the returned error channel.
+	TryListen(ListenConfig) (chan ConsumerMessage, <-chan error, error)
+	// ListenWithHandler calls handler for each message delivered to the queue, acknowledging it
+	// according to the ListenConfig AckMode, and returns a Listener to observe the consumer,
+	// returns an error if exchange, kind, queue or handler are not passed or if an error occurred
+	// while creating the amqp consumer.
+	ListenWithHandler(c ListenConfig, handler func(ConsumerMessage) error) (*Listener, error)
+	// ListenStream calls handler for each message of the stream queue, in order, and returns a
+	// StreamListener to checkpoint the offset of the last processed one to store, returns an error
+	// if exchange, kind, queue or handler are not passed, if loading the offset fails or if an error
+	// occurred while creating the amqp consumer.
+	ListenStream(c ListenConfig, store OffsetStore, handler func(ConsumerMessage)) (*StreamListener, error)
+	// NewRouter returns a Router that manages the bindings of a single queue and dispatches
+	// its deliveries to handlers by topic pattern, returns an error if exchange, kind or queue
+	// are not passed or if an error occurred while declaring the queue.
+	NewRouter(ListenConfig) (*Router, error)
+	// ConsumeBatch consumes messages in batches of up to maxSize deliveries, or whatever was received
+	// within maxWait, and acks or nacks the whole batch depending on the handler result, returns
+	// an error if exchange, kind, queue or handler are not passed, if maxSize is not positive or if an
+	// error occurred while creating the amqp consumer. Stopping the Listener handles the partial batch.
+	ConsumeBatch(c ListenConfig, maxSize int, maxWait time.Duration, handler func([]ConsumerMessage) error) (*Listener, error)
+	// DeclareTopology declares exchanges, queues, and the bindings between them, declaring them again
+	// after every reconnect. Returns an error if any of the declarations fails.
+	DeclareTopology(Topology) error
+	// BindExchange binds the destination exchange to the source one with key, binding it again after
+	// every reconnect. Both exchanges must already be declared.
+	BindExchange(destination, source, key string, args amqp.Table) error
+	// DeclareParkingQueue declares a durable queue holding dead-lettered messages for manual inspection.
+	DeclareParkingQueue(queue string) error
+	// QueueDepth returns the number of messages ready to be delivered from a queue.
+	QueueDepth(queue string) (int, error)
+	// Replay republishes up to limit parked messages to their original destination, read from
+	// the x-death header, or to targetExchange when it is not empty. The messages without x-death are skipped.
+	Replay(parkingQueue, targetExchange string, limit int) error
+	// Recover replaces the producer and consumer channels with new ones on the current connection.
+	Recover() error
+	// ServerProperties returns the properties the broker reported on connecting, e.g. its version.
+	ServerProperties() amqp.Table
+	// IsConnected reports whether the connection to the broker is open, e.g. for readiness probes.
+	IsConnected() bool
+	// CircuitState returns the state of the circuit breaker: "closed", "half-open" or "open".
+	CircuitState() string
+	// Generation returns the connection generation, starting at zero and incremented every time
+	// the connection is recovered after a broker outage.
+	Generation() uint64
+	// Close stops accepting messages, waits for the ones already emitted to be published or to fail,
+	// up to Config.CloseTimeout, and closes channel and connection, returning the first error
+	// closing them. Closing again returns nil.
+	Close() error
 }
 
 // Config carries the variables to tune a newly started rabbus.
 type Config struct {
 	// Dsn is the amqp url address.
 	Dsn string
-	// Durable indicates of the queue will survive broker restarts. Default to true.
+	// Durable indicates of the queue will survive broker restarts. Default to true with New.
 	Durable bool
 	// Attempts is the max number of retries on broker outages.
 	Attempts int
 	// Sleep is the sleep time of the retry mechanism.
 	Sleep time.Duration
+	// RetryBackoff returns the wait after the failed attempt number attempt, starting at 1, instead of Sleep,
+	// e.g. JitteredBackoff so many producers retrying against a recovering broker do not retry all at once.
+	// Default to Sleep, doubling after each attempt.
+	RetryBackoff func(attempt int) time.Duration
 	// Interval is the cyclic period of the closed state for CircuitBreaker to clear the internal counts,
 	// If Interval is 0, CircuitBreaker doesn't clear the internal counts during the closed state.
 	Interval time.Duration
@@ -54,10 +158,158 @@ type Config struct {
 	Timeout time.Duration
 	// Threshold when a threshold of failures has been reached, future calls to the broker will not run.
 	// During this state, the circuit breaker will periodically allow the calls to run and, if it is successful,
-	// will start running the function again. Default value is 5.
+	// will start running the function again. Every attempt to publish counts on its own, so a message failing
+	// Attempts times counts as many failures, and its remaining attempts are given up once the breaker opens.
+	// Default value is 5.
 	Threshold uint32
 	// OnStateChange is called whenever the state of CircuitBreaker changes.
 	OnStateChange func(name, from, to string)
+	// ReadyToTrip decides whether the CircuitBreaker trips after a failure from its counts, e.g. on a failure
+	// ratio over a number of requests. Default to trip once the consecutive failures exceed Threshold.
+	ReadyToTrip func(counts gobreaker.Counts) bool
+	// Logger logs the reconnect attempts, the failed dials and channels, the retried publishings and the
+	// CircuitBreaker state changes. Default to no logging.
+	Logger Logger
+	// Metrics observes every publishing and the CircuitBreaker state. Default to none.
+	Metrics MetricsObserver
+	// Context closes the Rabbus once done, stopping every consumer and the publishing, as Close does.
+	Context context.Context
+	// DisableReconnect disables the automatic reconnection when the connection to the broker is lost,
+	// OnClose is called instead so the application can decide how to proceed, e.g. exiting. Default to false.
+	DisableReconnect bool
+	// BeforePublish is called with every message right before it is published, after the defaults
+	// were applied, letting it be changed or rejected. A returned error is sent to EmitErr and
+	// the message is not published, such errors do not count as failures for the CircuitBreaker.
+	BeforePublish func(m *Message) error
+	// DefaultContentEncoding is the content-encoding of messages without one, empty meaning none.
+	DefaultContentEncoding string
+	// Compression compresses the payload of the messages without a content-encoding,
+	// ConsumerMessage.Unmarshal decompresses them. Default to CompressionNone.
+	Compression Compression
+	// CompressionThreshold is the min payload size in bytes to compress, smaller payloads are published
+	// as they are since compressing them saves little or even grows them. Default to 512.
+	CompressionThreshold int
+	// DialAttempts is the max number of attempts to connect to the broker when starting, waiting
+	// between them as when reconnecting, so the broker may come up a few seconds after the application.
+	// Default to a single attempt.
+	DialAttempts int
+	// ReconnectSleep is the wait before the first attempt to connect again, after the connection to the broker
+	// was lost or a failed DialAttempts. Default to 2 seconds.
+	ReconnectSleep time.Duration
+	// ReconnectMaxSleep caps the wait between attempts to connect, which doubles after each failed attempt
+	// from ReconnectSleep. Default to ReconnectSleep, waiting the same after every attempt.
+	ReconnectMaxSleep time.Duration
+	// Heartbeat is the interval of the heartbeats negotiated with the broker, a shorter one detects
+	// dead connections sooner, e.g. behind load balancers dropping idle connections. Default to 10 seconds.
+	Heartbeat time.Duration
+	// Locale is the locale negotiated with the broker, e.g. for its error messages. Default to "en_US".
+	Locale string
+	// TLSServerName is the name the broker certificate is verified against on amqps connections,
+	// when it differs from the Dsn host, e.g. through a load balancer. Default to the Dsn host.
+	TLSServerName string
+	// TLSConfig is used on amqps connections, e.g. with the client certificates for mutual TLS or the
+	// CA roots to verify the broker certificate against. TLSServerName overrides its ServerName when set.
+	// Default to the system roots without client certificates.
+	TLSConfig *tls.Config
+	// ConnectionProperties are advertised to the broker when connecting, on top of the
+	// library defaults, e.g. the product and version of the service to identify its connections.
+	// The client capabilities are always set by amqp, which already advertises consumer_cancel_notify
+	// and connection.blocked.
+	ConnectionProperties amqp.Table
+	// ConnectionName is advertised to the broker as the connection_name property, naming the connections
+	// in the management UI. It overrides the one from ConnectionProperties. Default to none.
+	ConnectionName string
+	// Vhost is the virtual host to connect to, overriding the one from the Dsn. Default to the Dsn vhost.
+	Vhost string
+	// NamePrefix is prepended to every exchange and queue name when declaring, binding, consuming and
+	// publishing, e.g. "staging." to share a cluster between environments. The default exchange
+	// and the broker reserved "amq." exchanges are never prefixed.
+	NamePrefix string
+	// OnClose is called with the connection error when the connection to the broker is lost
+	// and DisableReconnect is true.
+	OnClose func(err error)
+	// Mandatory publishes the messages as mandatory, the broker returns those not routed to any queue,
+	// instead of dropping them, and OnReturn is called with each of them. Default to false.
+	Mandatory bool
+	// OnReturn is called with every message returned by the broker as unroutable.
+	OnReturn func(ret amqp.Return)
+	// ValidateRoutingKey rejects the messages to topic exchanges whose routing key has an empty word
+	// or a wildcard within a word, e.g. orders..created, with ErrInvalidRoutingKey before publishing them.
+	// Default to false.
+	ValidateRoutingKey bool
+	// Codec marshals the values emitted by EmitValue and EmitMessageValue without content-type, e.g. to publish every
+	// value as MessagePack. Default to the registered codec accepting the value or else JSON.
+	Codec Codec
+	// Encoder encodes the values emitted by EmitValue, and by EmitMessageValue without content-type,
+	// along with their content-type, taking precedence over Codec. Default to Codec, or else the
+	// registered codec accepting the value, falling back to JSON.
+	Encoder Encoder
+	// CloseTimeout is how long Close waits for the messages already emitted to be published. Default to 5 seconds.
+	CloseTimeout time.Duration
+	// OnReconnect is called once the connection to the broker is recovered, along with the producer
+	// and the consumers, with the number of attempts it took.
+	OnReconnect func(attempt int)
+	// EnablePublisherConfirms puts the producer channel in confirm mode, every message waits for the broker
+	// to confirm it before its result is reported, e.g. on EmitOk, and it is retried when nacked.
+	// ConfirmBatchWindow takes precedence for higher throughput. Default to false.
+	EnablePublisherConfirms bool
+	// ConfirmBatchWindow enables pipelined publisher confirms when greater than zero: messages are
+	// published continuously while the broker confirms are reconciled in the background every window,
+	// so the result of a message, e.g. on EmitErr and EmitOk, is only reported once it is confirmed.
+	// Messages nacked by the broker fail with ErrNacked. Default to 0, no confirms.
+	ConfirmBatchWindow time.Duration
+	// MaxInFlight is the max number of published messages waiting for a confirm, publishing blocks
+	// once it is reached. Only used with ConfirmBatchWindow, default to 1024.
+	MaxInFlight int
+	// Propagator injects the trace context of the messages published into their headers and extracts it
+	// from the messages consumed, see ConsumerMessage.Context. Default to none.
+	Propagator Propagator
+	// StartConsumerSpan starts the consumer span of every message consumed, as a child of the trace context
+	// in ctx, and returns the context carrying it, see ConsumerMessage.Context. The handler ends the span,
+	// e.g. with trace.SpanFromContext(m.Context()).End(). Default to none.
+	StartConsumerSpan func(ctx context.Context, m ConsumerMessage) context.Context
+	// EmitResults reports the result of every message emitted asynchronously on EmitResults along with
+	// the message, instead of EmitOk and EmitErr, which tell neither what message the result is for.
+	// Default to false.
+	EmitResults bool
+	// ConsumerBufferSize is the buffer of the channels returned by Listen, ListenWithContext, ListenWithCancel
+	// and TryListen, trading memory for the deliveries read ahead of the caller, on top of the prefetch.
+	// Default to 256.
+	ConsumerBufferSize int
+	// PublishChannels is the number of producer channels publishing in parallel, each one with its own
+	// confirms and delivery tags. The messages emitted concurrently are spread over them, so they may be
+	// published in another order than they were emitted, while a batch is always published on a single
+	// channel. The hooks, e.g. BeforePublish and OnPublished, may be called concurrently then. Default to 1.
+	PublishChannels int
+	// OnPublished is called with every message successfully published, once its result was reported,
+	// e.g. on EmitOk, so after the broker confirmed it when confirms are enabled.
+	OnPublished func(m Message)
+	// ExchangeDeliveryModes sets the delivery mode of the messages published to each exchange without one,
+	// e.g. Transient for an exchange of metrics. Default to Persistent for every exchange.
+	ExchangeDeliveryModes map[string]uint8
+	// ExchangeKinds sets the kind of each exchange, declaring those of the messages without Kind, e.g. the
+	// ones emitted by EmitValue, and of EmitRaw. Default to none, the messages need a Kind then.
+	ExchangeKinds map[string]string
+	// PassiveExchanges only checks that the exchanges of the messages exist, declaring them passively,
+	// so emitting fails with the broker NotFound error rather than creating an exchange missing from a
+	// pre-provisioned topology. Default to false.
+	PassiveExchanges bool
+	// SkipExchangeDeclare never declares the exchanges of the messages, assuming they exist, so emitting
+	// only requires the write permission, e.g. for a least-privilege account publishing to a
+	// pre-provisioned topology. The messages need no Kind then, and a missing exchange makes the broker
+	// close the channel. Default to false.
+	SkipExchangeDeclare bool
+	// ExchangeAutoDelete declares the exchanges, when emitting and listening, to be deleted by the broker
+	// once their last binding is removed. Like Durable it must match the exchanges already declared.
+	// Default to false.
+	ExchangeAutoDelete bool
+	// BlockedTimeout is how long publishing waits while the broker blocks the connection, e.g. on a memory
+	// alarm, before failing with ErrConnectionBlocked. Default to 30 seconds.
+	BlockedTimeout time.Duration
+	// OnBlocked is called whenever the broker blocks or unblocks the connection, with the reason of the block.
+	OnBlocked func(blocked bool, reason string)
+	// ShardHash hashes the shard keys of EmitSharded, it must be stable across processes. Default to FNV-1a.
+	ShardHash func(key string) uint32
 }
 
 // Message carries fields for sending messages.
@@ -74,6 +326,37 @@ type Message struct {
 	DeliveryMode uint8
 	// ContentType the message content-type.
 	ContentType string
+	// ContentEncoding the message content-encoding, e.g. gzip. Default to Config.DefaultContentEncoding.
+	ContentEncoding string
+	// Headers the application or exchange specific fields, e.g. for headers exchanges or tracing.
+	Headers amqp.Table
+	// CorrelationId the correlation identifier, e.g. echoed back by the reply of a request.
+	CorrelationId string
+	// ReplyTo the queue to reply to, e.g. for RPC.
+	ReplyTo string
+	// Expiration the time to live of the message in milliseconds, e.g. "60000", after which the broker
+	// drops it or dead-letters it. Default to empty, the message never expires.
+	Expiration string
+	// MessageId the message identifier, e.g. an idempotency key carried end-to-end. Default to empty.
+	MessageId string
+	// Timestamp the time the message was created, e.g. the one of the upstream event. Default to the publishing time.
+	Timestamp time.Time
+	// Priority the message priority, from 0 to the max priority of the queue, which delivers the messages
+	// with higher priority first, see ListenConfig.MaxPriority. Default to 0.
+	Priority uint8
+	// Context carries the trace context Config.Propagator injects into the headers, e.g. for the messages
+	// emitted asynchronously. Default to the context of EmitSyncWithContext, or else none.
+	Context context.Context
+	// Delay holds the message in an ExchangeDelayed exchange for the delay before it is routed, it is
+	// published in the DelayHeader in milliseconds. Other exchanges ignore it. Default to no delay.
+	Delay time.Duration
+	// Critical messages are still published while the circuit breaker is open,
+	// bypassing it, whereas regular messages fail fast.
+	Critical bool
+	// ExchangeDurable overrides Config.Durable when declaring the exchange, nil meaning unset.
+	ExchangeDurable *bool
+
+	idempotencyKey string
 }
 
 // ListenConfig carries fields for listening messages.
@@ -84,8 +367,105 @@ type ListenConfig struct {
 	Kind string
 	// Key the routing key name.
 	Key string
-	// Queue the queue name
+	// Queue the queue name, it may be left empty for an Exclusive queue, the broker generates the name then.
 	Queue string
+	// Exclusive declares the queue as used only by this connection, the broker deletes it once the
+	// connection is closed, e.g. for a per-instance subscription to a fanout exchange. Default to false.
+	Exclusive bool
+	// AutoDelete declares the queue to be deleted by the broker once its last consumer is cancelled.
+	// Default to false.
+	AutoDelete bool
+	// NoWait declares the queue and starts consuming from it without waiting for the broker to confirm
+	// them, saving a round trip per consumer, an error closes the channel instead. It cannot be used with
+	// a queue named by the broker. Default to false.
+	NoWait bool
+	// NoLocal asks the broker not to deliver the messages published on the same connection. RabbitMQ
+	// does not support it. Default to false.
+	NoLocal bool
+	// Bindings binds the queue to additional exchanges, each of them is declared along with the queue.
+	// Exchange and Kind may be left empty when Bindings is set.
+	Bindings []Binding
+	// PrefetchCount is the max number of unacknowledged deliveries the broker sends to the consumer,
+	// a negative value means no limit. Default to 10.
+	PrefetchCount int
+	// PrefetchSize is the max size in bytes of the unacknowledged deliveries the broker sends to the consumer,
+	// RabbitMQ does not implement it and refuses any value but zero. Default to 0, no limit.
+	PrefetchSize int
+	// GlobalQos applies PrefetchCount to all the consumers of the channel together instead of
+	// to each one of them. Default to false.
+	GlobalQos bool
+	// AckMode selects whether ListenWithHandler acknowledges the deliveries from the handler result
+	// or leaves it to the handler. Default to AutoAck.
+	AckMode AckMode
+	// ExchangeDurable overrides Config.Durable when declaring the exchanges, nil meaning unset.
+	ExchangeDurable *bool
+	// ExchangeInternal declares the exchanges as internal: the broker refuses publishing to them, they only
+	// receive messages through exchange-to-exchange bindings, see Topology. Default to false.
+	ExchangeInternal bool
+	// QueueDurable overrides Config.Durable when declaring the queue, nil meaning unset.
+	QueueDurable *bool
+	// QueueArgs the queue arguments, e.g. x-dead-letter-exchange, x-max-length or x-message-ttl, which must
+	// match the ones of the queue when it already exists, otherwise consuming fails with ErrQueueMismatch.
+	QueueArgs amqp.Table
+	// MaxPriority declares the queue as a priority queue, x-max-priority, delivering the messages with
+	// higher Message.Priority first. Like any argument it must match the one of the queue when it already
+	// exists. RabbitMQ recommends up to 10. Default to 0, no priorities.
+	MaxPriority uint8
+	// StreamOffset is where consuming a stream queue starts: "first", "last", "next", an offset as int64
+	// or a time.Time. Default to the broker default, "next".
+	StreamOffset interface{}
+	// AckStrategy decides when ListenWithHandler acknowledges the messages in AutoAck mode, e.g. in batches.
+	// Default to AckAfterHandler.
+	AckStrategy AckStrategy
+	// DedupStore enables skipping the duplicates in ListenWithHandler: the messages whose key is in the store
+	// are acked without calling the handler, the key of every message successfully handled is added to it,
+	// e.g. a MemoryDedupStore. Default to nil, no deduplication.
+	DedupStore DedupStore
+	// DedupHeader is the header carrying the key of the messages for DedupStore.
+	// Default to the IdempotencyKeyHeader header or else the message id.
+	DedupHeader string
+	// Concurrency is the number of messages ListenWithHandler handles at the same time. The messages with
+	// the same PartitionKey are still handled one at a time, in order, unless Unordered is set. PrefetchCount
+	// is raised to Concurrency when lower, for all the workers to be busy. Default to 1.
+	Concurrency int
+	// PartitionKey returns the key ordering the messages handled concurrently, e.g. an order id from a header.
+	// Default to the routing key.
+	PartitionKey func(m ConsumerMessage) string
+	// Unordered hands each message to the next idle worker when handling them concurrently, ignoring
+	// PartitionKey, so independent messages sharing a key are handled in parallel too. Default to false.
+	Unordered bool
+	// RetryDelays enables retries with backoff for ListenWithHandler: a message failing with an error other
+	// than ErrReject waits in a delay queue, "<queue>.retry.<n>", for the nth delay before going back to the
+	// queue. Once all the delays were tried, or when rejected, it is dead-lettered to "<queue>.dead".
+	// The queue is declared with a dead letter exchange, so enabling retries on an existing queue
+	// requires RecreateQueue or deleting it first.
+	RetryDelays []time.Duration
+	// Passive only checks that the exchanges and the queue exist, declaring them passively, so listening
+	// fails with the broker NotFound error rather than creating them when missing from a pre-provisioned
+	// topology. The bindings are still declared. Default to false.
+	Passive bool
+	// SkipDeclare consumes the queue as it is, neither declaring the exchanges, the queue and the delay
+	// queues of RetryDelays nor binding them, so listening only requires the read permission on a
+	// pre-provisioned topology. It requires Queue to be set. Default to false.
+	SkipDeclare bool
+	// RecreateQueue deletes and declares the queue again when it already exists with different
+	// arguments, instead of failing with ErrQueueMismatch. Use it with care: the messages in the
+	// queue are lost, and so are the bindings not declared by this ListenConfig. Default to false.
+	RecreateQueue bool
+	// ConsumerTag names the consumer, e.g. after the service and the host, so it can be told apart in
+	// the management UI, and it is cancelled by its tag on Listener.Stop. Default to a tag generated
+	// by the broker.
+	ConsumerTag string
+}
+
+// Binding carries the fields for binding a queue to an exchange.
+type Binding struct {
+	// Exchange the exchange name.
+	Exchange string
+	// Kind the exchange type.
+	Kind string
+	// Key the routing key name.
+	Key string
 }
 
 // Delivery wraps amqp.Delivery struct
@@ -93,28 +473,111 @@ type Delivery struct {
 	amqp.Delivery
 }
 
+// amqpChannel is the part of amqp.Channel used by rabbus, so tests can replace the broker with a fake.
+type amqpChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueInspect(name string) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueueUnbind(name, key, exchange string, args amqp.Table) error
+	ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	Close() error
+}
+
 type rabbus struct {
 	sync.RWMutex
-	conn       *amqp.Connection
-	ch         *amqp.Channel
-	breaker    *gobreaker.CircuitBreaker
-	emit       chan Message
-	emitErr    chan error
-	emitOk     chan struct{}
+	conn *amqp.Connection
+	// lanes publish in parallel, each one on its own producer channel, see Config.PublishChannels.
+	lanes   []*lane
+	breaker *gobreaker.CircuitBreaker
+	emit    chan Message
+	// async is the channel returned by EmitAsync, its messages are handed to enqueue.
+	async     chan Message
+	asyncOnce sync.Once
+	emitErr   chan error
+	emitOk    chan struct{}
+	results   chan EmitResult
+	// requests are run by the first lane available.
+	requests   chan func(l *lane)
 	config     Config
-	exDeclared map[string]struct{}
+	generation uint64
+	producer   channelSettings
+	consumers  []*consumer
+	topologies []Topology
+	flow       flow
+	// openChannel opens a channel on the current connection, tests replace it.
+	openChannel func() (amqpChannel, error)
+	closed      chan struct{}
+	closeOnce   sync.Once
+	// intake guards closing, emitters counts the calls handing messages to the register goroutines
+	// so Close waits for them, and none is counted anymore once closing.
+	intake   sync.RWMutex
+	closing  bool
+	emitters sync.WaitGroup
+	// consumersLock guards consumers while they are registered under the read lock.
+	consumersLock sync.Mutex
+}
+
+// lane is a producer channel along with its confirms and the exchanges declared on it, all of them
+// owned by the register goroutine of the lane, the only one publishing on the channel.
+type lane struct {
+	*rabbus
+	ch amqpChannel
+	// chLock guards ch and confirms against the readers other than the register goroutine of the lane,
+	// e.g. Close, along with renewed.
+	chLock sync.Mutex
+	// renewed is the channel handed over by a reconnect, the register goroutine publishes on it from
+	// its next publishing on, see renewProducer.
+	renewed           amqpChannel
+	renewedGeneration uint64
+	confirms          *confirmTracker
+	acks              <-chan amqp.Confirmation
+	exDeclared        map[string]struct{}
+	// index, epoch and connGeneration identify ch, see Receipt. The epoch is incremented every time ch
+	// is replaced, connGeneration is the generation of the connection ch was opened on.
+	index          int
+	epoch          uint64
+	connGeneration uint64
+	// tasks are run by this lane only, e.g. to replace its channel.
+	tasks   chan func(l *lane)
+	drained chan struct{}
+}
+
+// newLane returns a lane of r publishing on ch.
+func newLane(r *rabbus, ch amqpChannel) *lane {
+	return &lane{
+		rabbus:     r,
+		ch:         ch,
+		exDeclared: make(map[string]struct{}),
+		tasks:      make(chan func(l *lane)),
+		drained:    make(chan struct{}),
+	}
 }
 
 // NewRabbus returns a new Rabbus configured with the
 // variables from the config parameter, or returning an non-nil err
 // if an error occurred while creating connection and channel.
 func NewRabbus(c Config) (Rabbus, error) {
-	conn, err := amqp.Dial(c.Dsn)
+	return New(c.Dsn, withConfig(c))
+}
+
+func newRabbus(c Config) (Rabbus, error) {
+	conn, err := connect(c)
 	if err != nil {
 		return nil, err
 	}
 
-	ch, err := conn.Channel()
+	var producer channelSettings
+	producer.confirm = confirmsEnabled(c)
+	chs, err := openProducers(conn, producer, c.PublishChannels)
 	if err != nil {
 		return nil, err
 	}
@@ -124,39 +587,197 @@ func NewRabbus(c Config) (Rabbus, error) {
 	}
 
 	st := gobreaker.Settings{
-		Name:     "Rabbus",
-		Interval: c.Interval,
-		Timeout:  c.Timeout,
-		ReadyToTrip: func(counts gobreaker.Counts) bool {
-			return counts.ConsecutiveFailures > c.Threshold
-		},
+		Name:        "Rabbus",
+		Interval:    c.Interval,
+		Timeout:     c.Timeout,
+		ReadyToTrip: readyToTrip(c),
 		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
-			c.OnStateChange(name, from.String(), to.String())
+			c.logf("rabbus: circuit breaker %s changed from %s to %s", name, from, to)
+			if c.Metrics != nil {
+				c.Metrics.SetBreakerState(to.String())
+			}
+			if c.OnStateChange != nil {
+				c.OnStateChange(name, from.String(), to.String())
+			}
 		},
 	}
 
 	r := &rabbus{
-		conn:       conn,
-		ch:         ch,
-		breaker:    gobreaker.NewCircuitBreaker(st),
-		emit:       make(chan Message),
-		emitErr:    make(chan error),
-		emitOk:     make(chan struct{}),
-		config:     c,
-		exDeclared: make(map[string]struct{}),
+		conn:     conn,
+		breaker:  gobreaker.NewCircuitBreaker(st),
+		emit:     make(chan Message),
+		emitErr:  make(chan error),
+		emitOk:   make(chan struct{}),
+		results:  make(chan EmitResult),
+		requests: make(chan func(l *lane)),
+		config:   c,
+		producer: producer,
+		closed:   make(chan struct{}),
 	}
 
-	go r.register()
-	go notifyClose(c.Dsn, r)
+	r.openChannel = r.connChannel
+	for i, ch := range chs {
+		l := newLane(r, ch)
+		l.index = i
+		l.trackConfirms(ch)
+		go r.watchReturns(ch)
+		r.lanes = append(r.lanes, l)
+	}
+
+	if c.Context != nil {
+		go func() {
+			select {
+			case <-c.Context.Done():
+				r.Close()
+			case <-r.closed:
+			}
+		}()
+	}
+
+	for _, l := range r.lanes {
+		go l.register()
+	}
+	go r.watchBlocked(conn)
+	go notifyClose(r)
 
 	rab := r
 
 	return rab, nil
 }
 
+// openProducers opens n producer channels on conn, at least one, applying settings to each of them.
+func openProducers(conn *amqp.Connection, settings channelSettings, n int) ([]amqpChannel, error) {
+	if n <= 0 {
+		n = 1
+	}
+
+	chs := make([]amqpChannel, 0, n)
+	for i := 0; i < n; i++ {
+		ch, err := conn.Channel()
+		if err == nil {
+			err = settings.rearm(ch)
+		}
+		if err != nil {
+			for _, ch := range chs {
+				ch.Close()
+			}
+			return nil, err
+		}
+
+		chs = append(chs, ch)
+	}
+
+	return chs, nil
+}
+
+// readyToTrip returns the predicate tripping the CircuitBreaker, c.ReadyToTrip when set.
+func readyToTrip(c Config) func(gobreaker.Counts) bool {
+	if c.ReadyToTrip != nil {
+		return c.ReadyToTrip
+	}
+
+	return func(counts gobreaker.Counts) bool {
+		return counts.ConsecutiveFailures > c.Threshold
+	}
+}
+
 // EmitAsync emits a message to RabbitMQ, but does not wait for the response from broker.
+// The channel keeps being read once rabbus is closed, the messages sent then are answered with ErrClosed.
 func (r *rabbus) EmitAsync() chan<- Message {
-	return r.emit
+	r.asyncOnce.Do(func() {
+		r.async = make(chan Message)
+		go r.forwardAsync()
+	})
+
+	return r.async
+}
+
+// forwardAsync hands the messages sent on EmitAsync to enqueue, so Close waits for them like for TryEmit.
+// It never returns, a send on EmitAsync after Close would block forever otherwise.
+func (r *rabbus) forwardAsync() {
+	for m := range r.async {
+		if err := r.enqueue(m); err != nil {
+			r.reportClosed(m, err)
+		}
+	}
+}
+
+// reportClosed reports err for m, emitted once rabbus is closed, to EmitResults or EmitErr,
+// it is dropped unless being read since the results are not read anymore after closing as a rule.
+func (r *rabbus) reportClosed(m Message, err error) {
+	if r.config.EmitResults {
+		select {
+		case r.results <- EmitResult{Message: m, Err: err}:
+		default:
+		}
+		return
+	}
+
+	select {
+	case r.emitErr <- err:
+	default:
+	}
+}
+
+// TryEmit emits m asynchronously, the result is reported through EmitOk and EmitErr.
+// When the circuit breaker is open it returns ErrCircuitOpen right away instead, unless m is critical,
+// and once rabbus is closed it returns ErrClosed.
+func (r *rabbus) TryEmit(m Message) error {
+	if r.circuitOpen(m) {
+		return ErrCircuitOpen
+	}
+
+	return r.enqueue(m)
+}
+
+// EmitValue encodes v with Config.Encoder and emits it asynchronously to exchange with the routing key
+// key like EmitMessageValue, declaring the exchange with its kind from Config.ExchangeKinds.
+func (r *rabbus) EmitValue(exchange, key string, v interface{}) error {
+	return r.EmitMessageValue(Message{Exchange: exchange, Key: key}, v)
+}
+
+// EmitMessageValue marshals v into m.Payload and emits m asynchronously, the result is reported through
+// EmitOk and EmitErr. The codec registered for m.ContentType is used when it is set, otherwise
+// Config.Encoder, Config.Codec or else the first registered codec accepting v, e.g. protobuf for
+// proto.Message values, falling back to JSON. m.ContentType is set to the content-type of the encoding.
+func (r *rabbus) EmitMessageValue(m Message, v interface{}) error {
+	payload, contentType, err := r.encode(m, v)
+	if err != nil {
+		return err
+	}
+
+	m.Payload = payload
+	m.ContentType = contentType
+
+	return r.enqueue(m)
+}
+
+// encode returns the encoding of v for m along with its content-type.
+func (r *rabbus) encode(m Message, v interface{}) ([]byte, string, error) {
+	if m.ContentType == "" && r.config.Encoder != nil {
+		return r.config.Encoder.Encode(v)
+	}
+
+	c, err := r.valueCodec(m, v)
+	if err != nil {
+		return nil, "", err
+	}
+
+	payload, err := c.Marshal(v)
+	return payload, c.ContentType(), err
+}
+
+// valueCodec returns the codec EmitMessageValue marshals v with for m.
+func (r *rabbus) valueCodec(m Message, v interface{}) (Codec, error) {
+	if c := r.config.Codec; c != nil && (m.ContentType == "" || m.ContentType == c.ContentType()) {
+		return c, nil
+	}
+
+	if m.ContentType != "" {
+		return codecFor(m.ContentType)
+	}
+
+	return codecForValue(v), nil
 }
 
 // EmitErr returns an error if encoding payload fails, or if after circuit breaker is open or retries attempts exceed.
@@ -169,120 +790,1017 @@ func (r *rabbus) EmitOk() <-chan struct{} {
 	return r.emitOk
 }
 
+// EmitResult is the result of a message emitted asynchronously.
+type EmitResult struct {
+	// Message the message as it was emitted.
+	Message Message
+	// Receipt the producer channel the message was published on, zero when it was not published.
+	Receipt Receipt
+	// Err the error emitting the message, nil once it was sent.
+	Err error
+}
+
+// Receipt tells which producer channel a message was published on, and its delivery tag there.
+// Delivery tags start over on every new producer channel, the channel is told apart by its generation,
+// its index and its epoch, so together with them a tag identifies a single publishing.
+type Receipt struct {
+	// Generation the generation of the connection the message was published on, see Generation.
+	Generation uint64
+	// Channel the index of the producer channel, from 0 to Config.PublishChannels - 1.
+	Channel int
+	// Epoch counts the times the producer channel was replaced, by a reconnect, Recover or a channel error.
+	Epoch uint64
+	// Tag the delivery tag the broker confirmed the message with, 0 when confirms are disabled.
+	Tag uint64
+}
+
+// EmitResults returns the result of every message emitted asynchronously, carrying the message so the
+// results of concurrent emits can be told apart, e.g. by Message.MessageId. Only used with Config.EmitResults,
+// EmitOk and EmitErr are not used then.
+func (r *rabbus) EmitResults() <-chan EmitResult {
+	return r.results
+}
+
+// EmitSync publishes m and waits for the result, including the broker confirm when confirms are enabled.
+// Unlike EmitAsync the result is not reported through EmitOk and EmitErr, so concurrent callers
+// each get their own.
+func (r *rabbus) EmitSync(m Message) error {
+	return r.EmitSyncWithContext(context.Background(), m)
+}
+
+// EmitSyncWithContext publishes m and waits for the result like EmitSync, returning ctx.Err() once ctx is done.
+// The retries stop at the next attempt, but a message already handed to the broker may still be delivered.
+func (r *rabbus) EmitSyncWithContext(ctx context.Context, m Message) error {
+	_, err := r.doContext(ctx, func(l *lane, done published) {
+		l.send(ctx, m, true, done)
+	})
+	return err
+}
+
+// EmitNoDeclare publishes m and waits for the result, skipping the exchange declaration
+// entirely. It suits pre-provisioned topologies and credentials without configure permission,
+// but it fails at publish time if the exchange does not exist.
+func (r *rabbus) EmitNoDeclare(m Message) error {
+	_, err := r.do(func(l *lane, done published) {
+		l.send(context.Background(), m, false, done)
+	})
+	return err
+}
+
+// EmitConfirm publishes m and waits for the broker to confirm it, returning the receipt of the producer
+// channel the broker confirmed it on. Delivery tags are sequence numbers of the producer channel, starting at 1
+// and strictly increasing in publishing order, but each producer channel has its own and they start over
+// on every new channel, e.g. after a reconnect or Recover, so only the whole receipt identifies a publishing.
+func (r *rabbus) EmitConfirm(m Message) (Receipt, error) {
+	if !confirmsEnabled(r.config) {
+		return Receipt{}, ErrConfirmsDisabled
+	}
+
+	return r.do(func(l *lane, done published) {
+		l.send(context.Background(), m, true, done)
+	})
+}
+
+// EmitRaw publishes pub to exchange with the routing key key as it is and waits for the result,
+// through the circuit breaker, the retries and the confirms like any other message. The caller owns
+// every property of pub, none of the defaults, hooks or compression of Message apply.
+// The exchange is declared with its kind from Config.ExchangeKinds and Config.Durable the first time it
+// is seen, unless the producer declared it already, e.g. publishing a Message with ExchangeDurable, or
+// Config.SkipExchangeDeclare is set. Otherwise an exchange without kind fails with ErrMissingKind.
+func (r *rabbus) EmitRaw(exchange, key string, pub amqp.Publishing) error {
+	kind := r.config.ExchangeKinds[exchange]
+	if err := r.validate(Message{Exchange: exchange, Kind: kind, Key: key}, true); err != nil {
+		return err
+	}
+
+	exchange = r.name(exchange)
+
+	_, err := r.do(func(l *lane, done published) {
+		if err := l.declareExchange(exchange, kind, r.config.Durable); err != nil {
+			done(Receipt{}, err)
+			return
+		}
+
+		l.publish(context.Background(), exchange, key, false, pub, done)
+	})
+	return err
+}
+
+// Forward republishes msg to exchange with the routing key key and waits for the result.
+// The body, headers and properties of msg are preserved, except for the user id which the broker
+// validates against the connection user. The exchange must already exist.
+func (r *rabbus) Forward(msg ConsumerMessage, exchange, key string) error {
+	pub := msg.publishing()
+	_, err := r.do(func(l *lane, done published) {
+		l.publish(context.Background(), r.name(exchange), key, false, pub, done)
+	})
+	return err
+}
+
 // Listen to a message from RabbitMQ, returns
 // an error if exchange, queue name and function handler not passed or if an error occurred while creating
 // amqp consumer.
 func (r *rabbus) Listen(c ListenConfig) (chan ConsumerMessage, error) {
-	if c.Exchange == "" {
-		return nil, ErrMissingExchange
+	if err := validateListenConfig(c); err != nil {
+		return nil, err
+	}
+
+	messages := r.messages()
+	if err := r.consume(r.forwarder(c, messages, r.closed)); err != nil {
+		return nil, err
 	}
 
-	if c.Kind == "" {
-		return nil, ErrMissingKind
+	return messages, nil
+}
+
+// ListenWithContext is like Listen but stops consuming once ctx is done: the consumer is cancelled,
+// it is not subscribed again after a reconnect, and the returned channel is closed. The messages
+// not acknowledged by then are redelivered by the broker.
+func (r *rabbus) ListenWithContext(ctx context.Context, c ListenConfig) (chan ConsumerMessage, error) {
+	messages, _, _, err := r.listenWithContext(ctx, c)
+	return messages, err
+}
+
+// ListenWithCancel is like Listen but returns a Listener to stop consuming at runtime, closing the
+// returned channel, or to unbind the queue.
+func (r *rabbus) ListenWithCancel(c ListenConfig) (chan ConsumerMessage, *Listener, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, cons, stopped, err := r.listenWithContext(ctx, c)
+	if err != nil {
+		cancel()
+		return nil, nil, err
 	}
 
-	if c.Queue == "" {
-		return nil, ErrMissingQueue
+	stop := func() (<-chan struct{}, error) {
+		cancel()
+		return stopped.done, <-stopped.err
 	}
 
-	if err := r.ch.ExchangeDeclare(c.Exchange, c.Kind, r.config.Durable, false, false, false, nil); err != nil {
-		return nil, err
+	return messages, r.listener(cons, stop), nil
+}
+
+// cancellation reports the error cancelling a consumer, then closes done once the messages channel is closed.
+type cancellation struct {
+	err  chan error
+	done chan struct{}
+}
+
+// listenWithContext starts the consumer of ListenWithContext, returning it along with its cancellation.
+func (r *rabbus) listenWithContext(ctx context.Context, c ListenConfig) (chan ConsumerMessage, *consumer, cancellation, error) {
+	if err := validateListenConfig(c); err != nil {
+		return nil, nil, cancellation{}, err
+	}
+
+	messages := r.messages()
+	cons := r.forwarder(c, messages, ctx.Done())
+	if err := r.consume(cons); err != nil {
+		return nil, nil, cancellation{}, err
+	}
+
+	s := cancellation{err: make(chan error, 1), done: make(chan struct{})}
+	go func() {
+		<-ctx.Done()
+		s.err <- r.cancel(cons)
+		<-cons.handled()
+		close(messages)
+		close(s.done)
+	}()
+
+	return messages, cons, s, nil
+}
+
+// TryListen is like Listen but sets up the consumer in the background, so many of them can be started
+// in parallel. The result of the setup is sent on the returned error channel, nil once the consumer
+// is ready. The ListenConfig is still validated right away.
+func (r *rabbus) TryListen(c ListenConfig) (chan ConsumerMessage, <-chan error, error) {
+	if err := validateListenConfig(c); err != nil {
+		return nil, nil, err
+	}
+
+	messages := r.messages()
+	ready := make(chan error, 1)
+	go func() {
+		ready <- r.consume(r.forwarder(c, messages, r.closed))
+	}()
+
+	return messages, ready, nil
+}
+
+// forwarder returns a consumer sending its deliveries to messages until done is closed, the deliveries
+// nobody reads then are redelivered once its channel is closed.
+func (r *rabbus) forwarder(c ListenConfig, messages chan ConsumerMessage, done <-chan struct{}) *consumer {
+	return &consumer{
+		config:   r.prefixed(c),
+		settings: c.settings(),
+		setup:    bindQueue,
+		handle: func(msgs <-chan amqp.Delivery, s *session) {
+			for m := range msgs {
+				select {
+				case messages <- newConsumerMessage(m, s):
+				case <-done:
+				}
+			}
+		},
+	}
+}
+
+// ServerProperties returns the properties the broker reported when the current connection was opened,
+// e.g. its "product" and "version" and the "capabilities" it supports.
+func (r *rabbus) ServerProperties() amqp.Table {
+	r.RLock()
+	defer r.RUnlock()
+	return r.conn.Properties
+}
+
+// IsConnected reports whether the connection to the broker is open. It is false while reconnecting
+// after a broker outage and once closed.
+func (r *rabbus) IsConnected() bool {
+	r.RLock()
+	defer r.RUnlock()
+	return r.conn != nil && !r.conn.IsClosed()
+}
+
+// receipt returns the receipt of the publishing with the given tag on the producer channel of l.
+func (l *lane) receipt(tag uint64) Receipt {
+	return Receipt{Generation: l.connGeneration, Channel: l.index, Epoch: l.epoch, Tag: tag}
+}
+
+// CircuitState returns the state of the circuit breaker: "closed", "half-open" or "open",
+// e.g. to expose it in metrics or to shed load before emitting while it is open.
+func (r *rabbus) CircuitState() string {
+	return r.breaker.State().String()
+}
+
+// Generation returns the connection generation, starting at zero and incremented every time
+// the connection is recovered after a broker outage. The generation of the connection that handled
+// each message is told by its Receipt, from EmitConfirm or EmitResults, since a reconnect may happen
+// between emitting it and reading Generation.
+func (r *rabbus) Generation() uint64 {
+	r.RLock()
+	defer r.RUnlock()
+	return r.generation
+}
+
+// Recover replaces the producer channels and the channel of every consumer with new ones on the
+// current connection, restoring their settings, e.g. after a channel error while the connection is fine.
+// The producer channels are swapped between publishings, the deliveries of the old consumer channels
+// become stale and the messages waiting for a confirm on the old producer channels fail with ErrConfirmLost.
+func (r *rabbus) Recover() error {
+	for _, l := range r.lanes {
+		if _, err := r.request(context.Background(), l.tasks, func(l *lane, done published) {
+			done(Receipt{}, l.recoverProducer())
+		}); err != nil {
+			return err
+		}
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+
+	r.consumersLock.Lock()
+	consumers := append([]*consumer(nil), r.consumers...)
+	r.consumersLock.Unlock()
+
+	for _, c := range consumers {
+		old, _ := c.channel()
+		if err := r.subscribe(r.conn, c); err != nil {
+			return err
+		}
+
+		if old != nil {
+			old.Close()
+		}
 	}
 
-	q, err := r.ch.QueueDeclare(c.Queue, r.config.Durable, false, false, false, nil)
+	return nil
+}
+
+// recoverProducer replaces the producer channel of l, it must run on the register goroutine of l.
+func (l *lane) recoverProducer() error {
+	ch, err := l.openChannel()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if err := r.ch.QueueBind(q.Name, c.Key, c.Exchange, false, nil); err != nil {
-		return nil, err
+	if err := l.producer.rearm(ch); err != nil {
+		ch.Close()
+		return err
 	}
 
-	msgs, err := r.ch.Consume(q.Name, "", false, false, false, false, nil)
+	old := l.ch
+	l.swapProducer(ch)
+	old.Close()
+
+	return nil
+}
+
+// connChannel opens a channel on the current connection.
+func (r *rabbus) connChannel() (amqpChannel, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	ch, err := r.conn.Channel()
 	if err != nil {
 		return nil, err
 	}
 
-	messages := make(chan ConsumerMessage, 256)
-	go func(msgs <-chan amqp.Delivery, messages chan ConsumerMessage) {
-		for m := range msgs {
-			messages <- newConsumerMessage(m)
+	return ch, nil
+}
+
+// renewProducers hands chs, opened on the connection of the given generation, to the lanes, one for each.
+func (r *rabbus) renewProducers(chs []amqpChannel, generation uint64) {
+	for i, l := range r.lanes {
+		l.renewProducer(chs[i], generation)
+	}
+}
+
+// renewProducer hands ch, opened on the connection of the given generation, to l without waiting for
+// its register goroutine, which makes it the producer channel before its next publishing, see renew.
+// A channel handed over before and not taken yet is closed. A channel handed over once rabbus is
+// closed is closed along with the connection.
+func (l *lane) renewProducer(ch amqpChannel, generation uint64) {
+	l.chLock.Lock()
+	stale := l.renewed
+	l.renewed, l.renewedGeneration = ch, generation
+	confirms := l.confirms
+	l.chLock.Unlock()
+
+	// the confirms of the old channel will never come.
+	if confirms != nil {
+		confirms.fail(ErrConnectionClosed)
+	}
+
+	if stale != nil {
+		stale.Close()
+	}
+}
+
+// renew makes the channel handed over by renewProducer the producer channel of l, if any.
+// It must run on the register goroutine of l.
+func (l *lane) renew() {
+	l.chLock.Lock()
+	ch, generation := l.renewed, l.renewedGeneration
+	l.renewed = nil
+	l.chLock.Unlock()
+
+	if ch == nil {
+		return
+	}
+
+	// the publishings confirmed on the old channel meanwhile fail along with it.
+	if l.confirms != nil {
+		l.confirms.fail(ErrConnectionClosed)
+	}
+	old := l.ch
+	l.connGeneration = generation
+	l.swapProducer(ch)
+	old.Close()
+	// the exchanges may be gone along with the broker, e.g. after a restart.
+	l.exDeclared = make(map[string]struct{})
+}
+
+// swapProducer makes ch the producer channel of l. It must run on the register goroutine of l, the only
+// one publishing on it, so the channel and its confirms never change in the middle of a publishing.
+func (l *lane) swapProducer(ch amqpChannel) {
+	// the delivery tags start over on ch.
+	l.epoch++
+	l.chLock.Lock()
+	l.ch = ch
+	l.trackConfirms(ch)
+	l.chLock.Unlock()
+	go l.watchReturns(ch)
+}
+
+// producerChannel returns the producer channel of l to another goroutine than the register one of l,
+// which reads it without the lock since it is the only one replacing it.
+func (l *lane) producerChannel() amqpChannel {
+	l.chLock.Lock()
+	defer l.chLock.Unlock()
+	return l.ch
+}
+
+// Close stops accepting messages, EmitSync and the like fail with ErrClosed from now on, and waits for
+// the messages already handed to rabbus to be published or to fail, including their broker confirms,
+// before closing channel and connection. It gives up waiting after Config.CloseTimeout.
+func (r *rabbus) Close() (err error) {
+	r.closeOnce.Do(func() {
+		timeout := r.config.CloseTimeout
+		if timeout <= 0 {
+			timeout = defaultCloseTimeout
 		}
-	}(msgs, messages)
 
-	return messages, nil
+		r.shutdown(timeout)
+		err = r.closeProducers()
+
+		r.RLock()
+		conn := r.conn
+		r.RUnlock()
+		if cerr := conn.Close(); err == nil {
+			err = cerr
+		}
+	})
+
+	return err
 }
 
-// Close attempt to close channel and connection.
-func (r *rabbus) Close() {
-	r.ch.Close()
-	r.conn.Close()
+// closeProducers closes the producer channel of every lane, returning the first error closing them.
+// A register goroutine shutdown gave up waiting for may still be swapping its channel, a channel
+// swapped in afterwards is closed along with the connection.
+func (r *rabbus) closeProducers() (err error) {
+	for _, l := range r.lanes {
+		if cerr := l.producerChannel().Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
 }
 
-func (r *rabbus) register() {
-	for m := range r.emit {
-		r.produce(m)
+// shutdown stops accepting messages, waits for the calls already handing messages over to be done,
+// while the register goroutines keep publishing them, then stops the register goroutines once the
+// pending confirms are settled. It gives up waiting after timeout.
+func (r *rabbus) shutdown(timeout time.Duration) {
+	r.intake.Lock()
+	r.closing = true
+	r.intake.Unlock()
+
+	// expired is closed rather than sent on, both waits below give up once it is.
+	expired := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() { close(expired) })
+	defer timer.Stop()
+
+	emitted := make(chan struct{})
+	go func() {
+		r.emitters.Wait()
+		close(emitted)
+	}()
+
+	select {
+	case <-emitted:
+	case <-expired:
+	}
+
+	close(r.closed)
+
+	for _, l := range r.lanes {
+		select {
+		case <-l.drained:
+		case <-expired:
+			return
+		}
 	}
 }
 
-func (r *rabbus) produce(m Message) {
-	if _, ok := r.exDeclared[m.Exchange]; !ok {
-		if err := r.ch.ExchangeDeclare(m.Exchange, m.Kind, r.config.Durable, false, false, false, nil); err != nil {
-			r.emitErr <- err
+// accept counts a call handing messages to the register goroutines, it reports false once closing.
+func (r *rabbus) accept() bool {
+	r.intake.RLock()
+	defer r.intake.RUnlock()
+
+	if r.closing {
+		return false
+	}
+
+	r.emitters.Add(1)
+	return true
+}
+
+// register publishes the messages emitted and runs the requests on the producer channel of l,
+// along with the other lanes, until rabbus is closed.
+func (l *lane) register() {
+	defer close(l.drained)
+
+	for {
+		select {
+		case <-l.closed:
+			if l.confirms != nil {
+				l.confirms.drain()
+			}
 			return
+		case m := <-l.emit:
+			// m was handed off already, it is published even when closing, its result dropped if unread.
+			l.renew()
+			l.produce(m)
+		case fn := <-l.requests:
+			l.renew()
+			fn(l)
+		case fn := <-l.tasks:
+			l.renew()
+			fn(l)
 		}
-		r.exDeclared[m.Exchange] = struct{}{}
 	}
+}
+
+// published reports the result of a publishing, along with the producer channel it was published on.
+type published func(r Receipt, err error)
+
+// do runs fn on the register goroutine of the first lane available, which owns its producer channel,
+// and waits for the result fn reports through done, which may come later from the confirms.
+func (r *rabbus) do(fn func(l *lane, done published)) (Receipt, error) {
+	return r.doContext(context.Background(), fn)
+}
+
+// doContext is like do but stops waiting once ctx is done.
+func (r *rabbus) doContext(ctx context.Context, fn func(l *lane, done published)) (Receipt, error) {
+	return r.request(ctx, r.requests, fn)
+}
+
+// request hands fn to the register goroutine reading requests, see do.
+func (r *rabbus) request(ctx context.Context, requests chan<- func(l *lane), fn func(l *lane, done published)) (Receipt, error) {
+	if !r.accept() {
+		return Receipt{}, ErrClosed
+	}
+	defer r.emitters.Done()
+
+	type result struct {
+		receipt Receipt
+		err     error
+	}
+
+	res := make(chan result, 1)
+	select {
+	case requests <- func(l *lane) {
+		fn(l, func(receipt Receipt, err error) { res <- result{receipt, err} })
+	}:
+	case <-r.closed:
+		return Receipt{}, ErrClosed
+	case <-ctx.Done():
+		return Receipt{}, ctx.Err()
+	}
+
+	select {
+	case out := <-res:
+		return out.receipt, out.err
+	case <-ctx.Done():
+		return Receipt{}, ctx.Err()
+	}
+}
+
+// enqueue hands m to the register goroutines to be published asynchronously, returning ErrClosed
+// once rabbus is closed instead of blocking.
+func (r *rabbus) enqueue(m Message) error {
+	if !r.accept() {
+		return ErrClosed
+	}
+	defer r.emitters.Done()
+
+	select {
+	case r.emit <- m:
+		return nil
+	case <-r.closed:
+		return ErrClosed
+	}
+}
+
+// produce sends m, reporting its result to EmitErr or EmitOk, or else EmitResults, until rabbus is closed,
+// the results nobody reads anymore are dropped then.
+func (l *lane) produce(m Message) {
+	l.send(context.Background(), m, true, func(receipt Receipt, err error) {
+		if l.config.EmitResults {
+			select {
+			case l.results <- EmitResult{Message: m, Receipt: receipt, Err: err}:
+			case <-l.closed:
+			}
+			return
+		}
+
+		if err != nil {
+			select {
+			case l.emitErr <- err:
+			case <-l.closed:
+			}
+			return
+		}
+
+		select {
+		case l.emitOk <- struct{}{}:
+		case <-l.closed:
+		}
+	})
+}
 
+// send applies the defaults to m, declares its exchange the first time it is seen
+// when declare is true and publishes it, reporting the result to done.
+func (l *lane) send(ctx context.Context, m Message, declare bool, done published) {
+	done = l.observe(m.Exchange, done)
+
+	if l.circuitOpen(m) {
+		done(Receipt{}, ErrCircuitOpen)
+		return
+	}
+
+	m, pub, err := l.prepare(ctx, m, declare)
+	if err != nil {
+		done(Receipt{}, err)
+		return
+	}
+
+	l.publish(ctx, m.Exchange, m.Key, m.Critical, pub, l.onPublished(m, done))
+}
+
+// prepare applies the defaults and the BeforePublish hook to m, validates it, declares its exchange the
+// first time it is seen when declare is true and returns m along with the publishing carrying it, with the
+// trace context of m.Context, or else ctx, in its headers when Config.Propagator is set.
+func (l *lane) prepare(ctx context.Context, m Message, declare bool) (Message, amqp.Publishing, error) {
 	if m.ContentType == "" {
 		m.ContentType = ContentTypeJSON
 	}
 
+	if err := l.compress(&m); err != nil {
+		return m, amqp.Publishing{}, err
+	}
+
+	if m.ContentEncoding == "" {
+		m.ContentEncoding = l.config.DefaultContentEncoding
+	}
+
+	if m.DeliveryMode == 0 {
+		m.DeliveryMode = l.config.ExchangeDeliveryModes[m.Exchange]
+	}
+
 	if m.DeliveryMode == 0 {
 		m.DeliveryMode = Persistent
 	}
 
-	if _, err := r.breaker.Execute(func() (interface{}, error) {
-		return nil, retry.Do(func() error {
-			return r.ch.Publish(m.Exchange, m.Key, false, false, amqp.Publishing{
-				ContentType:     m.ContentType,
-				ContentEncoding: "UTF-8",
-				DeliveryMode:    m.DeliveryMode,
-				Timestamp:       time.Now(),
-				Body:            m.Payload,
-			})
-		}, r.config.Attempts, r.config.Sleep)
-	}); err != nil {
-		r.emitErr <- err
-		return
+	if m.Kind == "" {
+		m.Kind = l.config.ExchangeKinds[m.Exchange]
+	}
+
+	if l.config.BeforePublish != nil {
+		if err := l.config.BeforePublish(&m); err != nil {
+			return m, amqp.Publishing{}, err
+		}
+	}
+
+	// m is validated as it is published, the hook may fill in what is missing or change anything.
+	if err := l.validate(m, declare); err != nil {
+		return m, amqp.Publishing{}, err
 	}
 
-	r.emitOk <- struct{}{}
+	m.Exchange = l.name(m.Exchange)
+
+	if declare {
+		if err := l.declareExchange(m.Exchange, m.Kind, l.durable(m.ExchangeDurable)); err != nil {
+			return m, amqp.Publishing{}, err
+		}
+	}
+
+	pub := amqp.Publishing{
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		DeliveryMode:    m.DeliveryMode,
+		Headers:         m.Headers,
+		CorrelationId:   m.CorrelationId,
+		ReplyTo:         m.ReplyTo,
+		Expiration:      m.Expiration,
+		Priority:        m.Priority,
+		MessageId:       m.MessageId,
+		Timestamp:       m.Timestamp,
+		Body:            m.Payload,
+	}
+
+	if pub.Timestamp.IsZero() {
+		pub.Timestamp = time.Now()
+	}
+
+	if m.idempotencyKey != "" || m.Delay > 0 || l.config.Propagator != nil {
+		// the headers of m belong to the caller, they are copied rather than changed.
+		pub.Headers = amqp.Table{}
+		for k, v := range m.Headers {
+			pub.Headers[k] = v
+		}
+
+		if m.idempotencyKey != "" {
+			pub.Headers[IdempotencyKeyHeader] = m.idempotencyKey
+		}
+
+		if m.Delay > 0 {
+			pub.Headers[DelayHeader] = int64(m.Delay / time.Millisecond)
+		}
+
+		if p := l.config.Propagator; p != nil {
+			if m.Context != nil {
+				ctx = m.Context
+			}
+			p.Inject(ctx, HeadersCarrier(pub.Headers))
+		}
+	}
+
+	return m, pub, nil
 }
 
-func notifyClose(dsn string, r *rabbus) {
-	err := <-r.conn.NotifyClose(make(chan *amqp.Error))
-	if err != nil {
-		for {
-			time.Sleep(time.Second * 2)
-			conn, err := amqp.Dial(dsn)
-			if err != nil {
-				continue
+// onPublished wraps done to call the OnPublished hook with m once it is published.
+func (r *rabbus) onPublished(m Message, done published) published {
+	if r.config.OnPublished == nil {
+		return done
+	}
+
+	return func(receipt Receipt, err error) {
+		done(receipt, err)
+		if err == nil {
+			r.config.OnPublished(m)
+		}
+	}
+}
+
+// declareExchange declares the exchange on the producer channel the first time it is seen.
+func (l *lane) declareExchange(exchange, kind string, durable bool) error {
+	if _, ok := l.exDeclared[exchange]; ok || l.config.SkipExchangeDeclare {
+		return nil
+	}
+
+	if err := l.retryTransient(func() error {
+		// the channel is looked up on every attempt, a failed one replaces it.
+		declare := l.ch.ExchangeDeclare
+		if l.config.PassiveExchanges {
+			declare = l.ch.ExchangeDeclarePassive
+		}
+
+		err := declare(exchange, kind, durable, l.config.ExchangeAutoDelete, false, false, exchangeArgs(kind))
+		if _, ok := err.(*amqp.Error); ok {
+			// the broker closed the channel, the next attempt and publishings need a new one.
+			if rerr := l.recoverProducer(); rerr != nil {
+				l.config.logf("rabbus: failed to recover the producer channel: %s", rerr)
 			}
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+	l.exDeclared[exchange] = struct{}{}
+
+	return nil
+}
+
+// publish publishes pub with the retry mechanism, each attempt through the circuit breaker,
+// critical publishings bypass the breaker when it is open.
+// The result is reported to done, once confirmed by the broker when confirms are enabled.
+func (l *lane) publish(ctx context.Context, exchange, key string, critical bool, pub amqp.Publishing, done published) {
+	if err := l.waitUnblocked(); err != nil {
+		done(Receipt{}, err)
+		return
+	}
+
+	var tag uint64
+	confirms := l.confirms
+	if confirms != nil {
+		tag = confirms.add(done)
+	}
+
+	var (
+		confirmed uint64
+		aborted   error
+	)
+	acks := l.acks
+	try := func() error {
+		// a cancelled publishing is not a broker failure, it stops the retries without tripping the breaker.
+		if aborted = ctx.Err(); aborted != nil {
+			return nil
+		}
+
+		if err := l.ch.Publish(exchange, key, l.config.Mandatory, false, pub); err != nil || acks == nil {
+			return err
+		}
+
+		// publishings are confirmed in order and this is the only one in flight.
+		c, ok := <-acks
+		if !ok {
+			return ErrConfirmLost
+		}
+		confirmed = c.DeliveryTag
+		if !c.Ack {
+			return ErrNacked
+		}
+
+		return nil
+	}
 
-			ch, err := conn.Channel()
-			if err != nil {
-				continue
+	// the breaker sees every attempt, so its counts reflect the broker health rather than the emits, and
+	// once it opens the remaining attempts are given up, except for critical publishings.
+	var rejected error
+	err := l.retryAttempts(func(attempt int) error {
+		_, err := l.breaker.Execute(func() (interface{}, error) {
+			return nil, try()
+		})
+		if isBreakerRejection(err) {
+			if !critical {
+				rejected = err
+				return nil
 			}
+			err = try()
+		}
+
+		if err != nil {
+			l.config.logf("rabbus: attempt %d publishing to exchange %q with key %q failed: %s", attempt, exchange, key, err)
+		}
+		return err
+	})
+	if rejected != nil {
+		err = rejected
+	}
+
+	if err == gobreaker.ErrOpenState {
+		err = ErrCircuitOpen
+	}
+
+	if err == nil && aborted != nil {
+		err = aborted
+	}
+
+	if confirms == nil {
+		if err != nil {
+			done(Receipt{}, err)
+			return
+		}
+		done(l.receipt(confirmed), nil)
+		return
+	}
+
+	if err != nil && confirms.remove(tag) {
+		done(Receipt{}, err)
+	}
+}
+
+// retryAttempts calls fn up to Config.Attempts times until it succeeds, with the number of the attempt, waiting
+// Config.RetryBackoff after each failed attempt when set, otherwise Config.Sleep doubling every time.
+func (r *rabbus) retryAttempts(fn func(attempt int) error) error {
+	attempt := 0
+	next := func() error {
+		attempt++
+		return fn(attempt)
+	}
+
+	if r.config.RetryBackoff == nil {
+		return retry.Do(next, r.config.Attempts, r.config.Sleep)
+	}
+
+	for {
+		err := next()
+		if err == nil || attempt >= r.config.Attempts {
+			return err
+		}
+		time.Sleep(r.config.RetryBackoff(attempt))
+	}
+}
 
-			r.Lock()
-			defer r.Unlock()
-			r.conn = conn
-			r.ch = ch
+// retryTransient calls fn until it succeeds, following the retry settings from the config.
+// Errors refused by the broker, such as precondition failures, are returned right away.
+func (r *rabbus) retryTransient(fn func() error) error {
+	var permanent error
+	err := r.retryAttempts(func(attempt int) error {
+		err := fn()
+		if err != nil && !isTransient(err) {
+			permanent = err
+			return nil
+		}
+		if err != nil {
+			r.config.logf("rabbus: attempt %d failed: %s", attempt, err)
+		}
+		return err
+	})
+	if permanent != nil {
+		return permanent
+	}
+
+	return err
+}
+
+// isTransient reports whether trying again may succeed after err.
+func isTransient(err error) bool {
+	if err == ErrQueueMismatch {
+		return false
+	}
+
+	e, ok := err.(*amqp.Error)
+	if !ok {
+		return true
+	}
+
+	switch e.Code {
+	case amqp.PreconditionFailed, amqp.AccessRefused, amqp.NotFound, amqp.ResourceLocked,
+		amqp.NotAllowed, amqp.CommandInvalid, amqp.NotImplemented, amqp.SyntaxError:
+		return false
+	}
+
+	return true
+}
+
+// circuitOpen reports whether m would be rejected by the breaker, critical messages never are.
+func (r *rabbus) circuitOpen(m Message) bool {
+	return !m.Critical && r.breaker.State() == gobreaker.StateOpen
+}
+
+// isBreakerRejection reports whether err means the breaker refused to run the call
+// rather than the call itself failing.
+func isBreakerRejection(err error) bool {
+	return err == gobreaker.ErrOpenState || err == gobreaker.ErrTooManyRequests
+}
+
+// notifyClose watches the connection until rabbus is closed, connecting again every time it is lost
+// unless Config.DisableReconnect is set.
+func notifyClose(r *rabbus) {
+	for {
+		r.RLock()
+		conn := r.conn
+		r.RUnlock()
+
+		// amqp does not close the connection until the error is received, rabbus may be closed meanwhile.
+		var err *amqp.Error
+		select {
+		case err = <-conn.NotifyClose(make(chan *amqp.Error, 1)):
+		case <-r.closed:
+			return
+		}
+
+		if err == nil {
+			// closed by Close.
+			return
+		}
 
-			go notifyClose(dsn, r)
+		if !r.connectionLost(err) {
+			return
+		}
+	}
+}
+
+// connectionLost handles the loss of the connection with err, calling Config.OnClose when
+// Config.DisableReconnect is set or else reconnecting. It reports whether rabbus is connected again.
+func (r *rabbus) connectionLost(err *amqp.Error) bool {
+	if r.config.DisableReconnect {
+		if r.config.OnClose != nil {
+			r.config.OnClose(err)
+		}
+		return false
+	}
+
+	r.config.logf("rabbus: connection lost: %s", err)
+	return r.reconnect()
+}
+
+// reconnect connects to the broker again, waiting for the backoff between attempts, and recovers the
+// producer channel, the topologies and the consumers on the new connection. It reports false when
+// rabbus was closed before reconnecting.
+func (r *rabbus) reconnect() bool {
+	b := newBackoff(r.config)
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(b.next()):
+		case <-r.closed:
+			return false
+		}
+
+		conn, err := dial(r.config)
+		if err != nil {
+			r.config.logf("rabbus: reconnect attempt %d failed to dial: %s", attempt, err)
+			continue
+		}
+
+		chs, err := openProducers(conn, r.producer, len(r.lanes))
+		if err != nil {
+			r.config.logf("rabbus: reconnect attempt %d failed to open the producer channels: %s", attempt, err)
+			conn.Close()
+			continue
+		}
+
+		r.Lock()
+		select {
+		case <-r.closed:
+			// Close is done with the previous connection.
+			r.Unlock()
+			conn.Close()
+			return false
+		default:
+		}
+
+		// the connection is swapped under the lock only, so the read lock is not held up by the recovery.
+		// A topology or a consumer registered from now on is declared or subscribed on conn already.
+		r.conn = conn
+		// the new connection starts unblocked, whatever the previous one was notified last.
+		r.flow.unblock()
+		go r.watchBlocked(conn)
+		r.generation++
+		generation := r.generation
+		topologies := append([]Topology(nil), r.topologies...)
+		r.consumersLock.Lock()
+		consumers := append([]*consumer(nil), r.consumers...)
+		r.consumersLock.Unlock()
+		r.Unlock()
 
-			break
+		// the lanes take their new channel at their next publishing, a lane waiting for its result
+		// to be read does not hold up the recovery.
+		r.renewProducers(chs, generation)
+
+		r.redeclareTopologies(connChannels(conn), topologies)
+
+		for _, c := range consumers {
+			r.recoverConsumer(conn, c)
+		}
+
+		r.config.logf("rabbus: reconnected after %d attempts", attempt)
+
+		if r.config.OnReconnect != nil {
+			r.config.OnReconnect(attempt)
 		}
+
+		return true
 	}
 }
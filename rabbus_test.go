@@ -1,10 +1,14 @@
 package rabbus
 
 import (
+	"context"
+	"runtime"
 	"strconv"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/streadway/amqp"
 )
 
 var RABBUS_DSN = "amqp://localhost:5672"
@@ -91,6 +95,311 @@ func TestRabbusListen_Validate(t *testing.T) {
 	}
 }
 
+func TestRabbusListen_PrefetchAfterRecover(t *testing.T) {
+	r, err := NewRabbus(Config{
+		Dsn:      RABBUS_DSN,
+		Attempts: 1,
+		Timeout:  time.Second * 2,
+		Durable:  true,
+	})
+	if err != nil {
+		t.Fatalf("Expected to init rabbus %s", err)
+	}
+	defer r.Close()
+
+	messages, err := r.Listen(ListenConfig{
+		Exchange:      "test_prefetch_ex",
+		Kind:          "direct",
+		Key:           "test_key",
+		Queue:         "test_prefetch_q",
+		PrefetchCount: 1,
+	})
+	if err != nil {
+		t.Fatalf("Expected to listen message %s", err)
+	}
+
+	if err := r.Recover(); err != nil {
+		t.Fatalf("Expected to recover channels %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := r.EmitNoDeclare(Message{
+			Exchange:     "test_prefetch_ex",
+			Key:          "test_key",
+			Payload:      []byte(`foo`),
+			DeliveryMode: Persistent,
+		}); err != nil {
+			t.Fatalf("Expected to emit message %s", err)
+		}
+	}
+
+	var m ConsumerMessage
+	for m = range messages {
+		if !m.Stale() {
+			break
+		}
+	}
+
+	select {
+	case <-messages:
+		t.Fatal("Expected the prefetch to hold the second message until the first is acked")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	m.Ack(false)
+
+	select {
+	case m = <-messages:
+		m.Ack(false)
+	case <-time.After(time.Second * 2):
+		t.Fatal("Expected the second message once the first is acked")
+	}
+}
+
+func TestRabbusListen_ResubscribeAfterChannelClose(t *testing.T) {
+	r, err := NewRabbus(Config{
+		Dsn:      RABBUS_DSN,
+		Attempts: 1,
+		Timeout:  time.Second * 2,
+	})
+	if err != nil {
+		t.Fatalf("Expected to init rabbus %s", err)
+	}
+	defer r.Close()
+
+	messages, err := r.Listen(ListenConfig{
+		Exchange: "test_resubscribe_ex",
+		Kind:     "direct",
+		Key:      "test_key",
+		Queue:    "test_resubscribe_q",
+	})
+	if err != nil {
+		t.Fatalf("Expected to listen message %s", err)
+	}
+
+	// the channel goes away while the connection stays open, e.g. after a channel error.
+	ch, _ := r.(*rabbus).consumers[0].channel()
+	ch.Close()
+
+	if err := r.EmitSync(Message{
+		Exchange: "test_resubscribe_ex",
+		Kind:     "direct",
+		Key:      "test_key",
+		Payload:  []byte(`foo`),
+	}); err != nil {
+		t.Fatalf("Expected to emit message %s", err)
+	}
+
+	select {
+	case m := <-messages:
+		m.Ack(false)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the consumer to be subscribed again on a new channel")
+	}
+}
+
+func TestRabbusListenWithContext(t *testing.T) {
+	r, err := NewRabbus(Config{
+		Dsn:      RABBUS_DSN,
+		Attempts: 1,
+		Timeout:  time.Second * 2,
+	})
+	if err != nil {
+		t.Fatalf("Expected to init rabbus %s", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, err := r.ListenWithContext(ctx, ListenConfig{
+		Exchange: "test_ctx_ex",
+		Kind:     "direct",
+		Key:      "test_key",
+		Queue:    "test_ctx_q",
+	})
+	if err != nil {
+		t.Fatalf("Expected to listen message %s", err)
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Fatal("Expected no message to be delivered")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the messages channel to be closed once the context is done")
+	}
+}
+
+func TestRabbusListenWithCancel(t *testing.T) {
+	r, err := NewRabbus(Config{
+		Dsn:      RABBUS_DSN,
+		Attempts: 1,
+		Timeout:  time.Second * 2,
+	})
+	if err != nil {
+		t.Fatalf("Expected to init rabbus %s", err)
+	}
+	defer r.Close()
+
+	messages, l, err := r.ListenWithCancel(ListenConfig{
+		Exchange:    "test_cancel_ex",
+		Kind:        "direct",
+		Key:         "test_key",
+		Queue:       "test_cancel_q",
+		ConsumerTag: "test_cancel_consumer",
+	})
+	if err != nil {
+		t.Fatalf("Expected to listen message %s", err)
+	}
+
+	if err := l.Unbind(); err != nil {
+		t.Fatalf("Expected to unbind the queue %s", err)
+	}
+
+	if err := l.Stop(); err != nil {
+		t.Fatalf("Expected to stop the listener %s", err)
+	}
+
+	if _, ok := <-messages; ok {
+		t.Fatal("Expected the messages channel to be closed once stopped")
+	}
+}
+
+func TestRabbusListenExclusiveQueue(t *testing.T) {
+	r, err := NewRabbus(Config{
+		Dsn:      RABBUS_DSN,
+		Attempts: 1,
+		Timeout:  time.Second * 2,
+	})
+	if err != nil {
+		t.Fatalf("Expected to init rabbus %s", err)
+	}
+	defer r.Close()
+
+	messages, err := r.Listen(ListenConfig{
+		Exchange:   "test_broadcast_ex",
+		Kind:       "fanout",
+		Exclusive:  true,
+		AutoDelete: true,
+	})
+	if err != nil {
+		t.Fatalf("Expected to listen message %s", err)
+	}
+
+	if err := r.EmitSync(Message{Exchange: "test_broadcast_ex", Kind: "fanout", Payload: []byte("foo")}); err != nil {
+		t.Fatalf("Expected to emit message %s", err)
+	}
+
+	select {
+	case m := <-messages:
+		m.Ack(false)
+	case <-time.After(time.Second * 2):
+		t.Fatal("Expected the message to be delivered to the broker named queue")
+	}
+}
+
+func TestRabbusListenSkipDeclare(t *testing.T) {
+	r, err := NewRabbus(Config{
+		Dsn:                 RABBUS_DSN,
+		Attempts:            1,
+		Timeout:             time.Second * 2,
+		SkipExchangeDeclare: true,
+	})
+	if err != nil {
+		t.Fatalf("Expected to init rabbus %s", err)
+	}
+	defer r.Close()
+
+	if err := r.DeclareTopology(Topology{
+		Exchanges:     []Exchange{{Name: "test_skip_ex", Kind: "direct"}},
+		Queues:        []Queue{{Name: "test_skip_q"}},
+		QueueBindings: []QueueBinding{{Queue: "test_skip_q", Exchange: "test_skip_ex", Key: "test_key"}},
+	}); err != nil {
+		t.Fatalf("Expected to declare the topology %s", err)
+	}
+
+	messages, err := r.Listen(ListenConfig{
+		Exchange:    "test_skip_ex",
+		Kind:        "direct",
+		Key:         "test_key",
+		Queue:       "test_skip_q",
+		SkipDeclare: true,
+	})
+	if err != nil {
+		t.Fatalf("Expected to listen message %s", err)
+	}
+
+	if err := r.EmitSync(Message{Exchange: "test_skip_ex", Key: "test_key", Payload: []byte("foo")}); err != nil {
+		t.Fatalf("Expected to emit message %s", err)
+	}
+
+	select {
+	case m := <-messages:
+		m.Ack(false)
+	case <-time.After(time.Second * 2):
+		t.Fatal("Expected the message to be delivered to the pre-provisioned queue")
+	}
+}
+
+func TestRabbusListenNoWait(t *testing.T) {
+	r, err := NewRabbus(Config{
+		Dsn:      RABBUS_DSN,
+		Attempts: 1,
+		Timeout:  time.Second * 2,
+	})
+	if err != nil {
+		t.Fatalf("Expected to init rabbus %s", err)
+	}
+	defer r.Close()
+
+	messages, err := r.Listen(ListenConfig{
+		Exchange: "test_nowait_ex",
+		Kind:     "direct",
+		Key:      "test_key",
+		Queue:    "test_nowait_q",
+		NoWait:   true,
+	})
+	if err != nil {
+		t.Fatalf("Expected to listen message %s", err)
+	}
+
+	if err := r.EmitSync(Message{Exchange: "test_nowait_ex", Kind: "direct", Key: "test_key", Payload: []byte("foo")}); err != nil {
+		t.Fatalf("Expected to emit message %s", err)
+	}
+
+	select {
+	case m := <-messages:
+		m.Ack(false)
+	case <-time.After(time.Second * 2):
+		t.Fatal("Expected the message to be delivered without waiting for the consumer")
+	}
+}
+
+func TestRabbusListenPassiveMissingQueue(t *testing.T) {
+	r, err := NewRabbus(Config{
+		Dsn:      RABBUS_DSN,
+		Attempts: 1,
+		Timeout:  time.Second * 2,
+	})
+	if err != nil {
+		t.Fatalf("Expected to init rabbus %s", err)
+	}
+	defer r.Close()
+
+	_, err = r.Listen(ListenConfig{
+		Exchange: "amq.direct",
+		Kind:     "direct",
+		Key:      "test_key",
+		Queue:    "test_passive_missing_q",
+		Passive:  true,
+	})
+	if e, ok := err.(*amqp.Error); !ok || e.Code != amqp.NotFound {
+		t.Fatalf("Expected the missing queue to be reported, got %v", err)
+	}
+}
+
 func TestRabbusClose(t *testing.T) {
 	r, err := NewRabbus(Config{
 		Dsn:      RABBUS_DSN,
@@ -98,10 +407,83 @@ func TestRabbusClose(t *testing.T) {
 		Timeout:  time.Second * 2,
 	})
 	if err != nil {
-		t.Errorf("Expected to init rabbus %s", err)
+		t.Fatalf("Expected to init rabbus %s", err)
+	}
+
+	if !r.IsConnected() {
+		t.Error("Expected to be connected")
+	}
+
+	if err := r.Close(); err != nil {
+		t.Errorf("Expected to close rabbus %s", err)
+	}
+
+	if r.IsConnected() {
+		t.Error("Expected not to be connected once closed")
 	}
 
-	r.Close()
+	if err := r.Close(); err != nil {
+		t.Errorf("Expected closing again to return nil, got %s", err)
+	}
+}
+
+func TestRabbusCloseStopsGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 3; i++ {
+		r, err := NewRabbus(Config{
+			Dsn:            RABBUS_DSN,
+			Attempts:       1,
+			Timeout:        time.Second * 2,
+			ReconnectSleep: time.Millisecond * 10,
+		})
+		if err != nil {
+			t.Fatalf("Expected to init rabbus %s", err)
+		}
+
+		for j := 0; j < 3; j++ {
+			forceReconnect(t, r)
+		}
+
+		if err := r.Close(); err != nil {
+			t.Fatalf("Expected to close rabbus %s", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second * 2)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("Expected %d goroutines once closed after reconnecting, got %d", before, n)
+	}
+}
+
+// forceReconnect makes the broker close the connection of r, declaring an exchange of an unknown kind
+// is a connection error, and waits for r to reconnect.
+func forceReconnect(t *testing.T, r Rabbus) {
+	rb := r.(*rabbus)
+	generation := r.Generation()
+
+	rb.RLock()
+	conn := rb.conn
+	rb.RUnlock()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Expected to open a channel %s", err)
+	}
+	ch.ExchangeDeclare("rabbus_unknown_kind", "unknown", false, true, false, false, nil)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for r.Generation() == generation && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if r.Generation() == generation {
+		t.Fatal("Expected rabbus to reconnect")
+	}
 }
 
 func BenchmarkEmitAsync(b *testing.B) {
@@ -139,3 +521,36 @@ func BenchmarkEmitAsync(b *testing.B) {
 	}
 	wg.Wait()
 }
+
+func BenchmarkEmitSyncPublishChannels(b *testing.B) {
+	for _, channels := range []int{1, 4} {
+		b.Run(strconv.Itoa(channels), func(b *testing.B) {
+			r, err := NewRabbus(Config{
+				Dsn:                     RABBUS_DSN,
+				Attempts:                1,
+				Timeout:                 time.Second * 2,
+				Durable:                 false,
+				EnablePublisherConfirms: true,
+				PublishChannels:         channels,
+			})
+			if err != nil {
+				b.Fatalf("Expected to init rabbus %s", err)
+			}
+			defer r.Close()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := r.EmitSync(Message{
+						Exchange: "test_bench_pool_ex",
+						Kind:     "direct",
+						Key:      "test_key",
+						Payload:  []byte(`foo`),
+					}); err != nil {
+						b.Errorf("Expected to emit message %s", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
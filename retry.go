@@ -0,0 +1,159 @@
+package rabbus
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// RetryAttemptHeader is the header counting how many times a message went through the retry queues.
+	RetryAttemptHeader = "x-retry-attempt"
+	// RetryCountHeader is the header counting how many times a message was retried with ConsumerMessage.Retry.
+	RetryCountHeader = "x-retry-count"
+)
+
+// retryQueue returns the name of the delay queue of the given retry tier.
+func retryQueue(queue string, tier int) string {
+	return queue + ".retry." + strconv.Itoa(tier)
+}
+
+// deadQueue returns the name of the queue collecting the messages that exhausted their retries.
+func deadQueue(queue string) string {
+	return queue + ".dead"
+}
+
+// queueArgs returns the arguments of the queue from c, along with its max priority and dead-lettering
+// to the dead queue when retries are enabled.
+func (c ListenConfig) queueArgs() amqp.Table {
+	if len(c.RetryDelays) == 0 && c.MaxPriority == 0 {
+		return c.QueueArgs
+	}
+
+	args := amqp.Table{}
+	for k, v := range c.QueueArgs {
+		args[k] = v
+	}
+
+	if c.MaxPriority > 0 {
+		args["x-max-priority"] = int32(c.MaxPriority)
+	}
+
+	if len(c.RetryDelays) > 0 {
+		args["x-dead-letter-exchange"] = ""
+		args["x-dead-letter-routing-key"] = deadQueue(c.Queue)
+	}
+
+	return args
+}
+
+// declareRetryQueues declares a delay queue for each retry tier of c with declare, dead-lettering
+// the expired messages back to the queue from c, and the dead queue.
+func (r *rabbus) declareRetryQueues(declare func(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error), c ListenConfig) error {
+	if len(c.RetryDelays) == 0 {
+		return nil
+	}
+
+	for tier, delay := range c.RetryDelays {
+		if _, err := declare(retryQueue(c.Queue, tier), r.durable(c.QueueDurable), false, false, false, amqp.Table{
+			"x-message-ttl":             int64(delay / time.Millisecond),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": c.Queue,
+		}); err != nil {
+			return err
+		}
+	}
+
+	_, err := declare(deadQueue(c.Queue), r.durable(c.QueueDurable), false, false, false, nil)
+	return err
+}
+
+// retry publishes a copy of m to the delay queue of its next retry tier, returning ErrReject once
+// the tiers are exhausted so m is dead-lettered. Acknowledging m is left to the caller.
+func (r *rabbus) retry(m ConsumerMessage, c ListenConfig) error {
+	attempt := retryAttempt(m.Headers)
+	if attempt >= len(c.RetryDelays) {
+		return ErrReject
+	}
+
+	pub := m.publishing()
+	headers := amqp.Table{}
+	for k, v := range pub.Headers {
+		headers[k] = v
+	}
+	headers[RetryAttemptHeader] = int64(attempt + 1)
+	pub.Headers = headers
+
+	_, err := r.do(func(l *lane, done published) {
+		l.publish(context.Background(), "", retryQueue(c.Queue, attempt), false, pub, done)
+	})
+	return err
+}
+
+// retryAttempt returns the number of retries recorded in headers.
+func retryAttempt(headers amqp.Table) int {
+	return headerCount(headers, RetryAttemptHeader)
+}
+
+// headerCount returns the counter held by the header name of headers, zero when missing.
+func headerCount(headers amqp.Table, name string) int {
+	switch n := headers[name].(type) {
+	case int64:
+		return int(n)
+	case int32:
+		return int(n)
+	case int16:
+		return int(n)
+	case int8:
+		return int(n)
+	}
+
+	return 0
+}
+
+// parkingExchange returns the name of the exchange collecting the messages retried too many times through dlx.
+func parkingExchange(dlx string) string {
+	return dlx + ".parking"
+}
+
+// Retry republishes a copy of the message to the dead letter exchange dlx, e.g. one routing to a delay
+// queue dead-lettering its expired messages back to the consumed queue, with the RetryCountHeader
+// incremented, then acks the message. Once retried maxRetries times, the message is republished to
+// the parking lot exchange "<dlx>.parking" instead. Both exchanges must already exist, and the copy
+// keeps the routing key of the message. When republishing fails the message is left unacknowledged.
+func (cm *ConsumerMessage) Retry(maxRetries int, dlx string) error {
+	if cm.session == nil || cm.session.rabbus == nil {
+		return ErrNotRetryable
+	}
+
+	if cm.Stale() {
+		return ErrStaleDelivery
+	}
+
+	count := headerCount(cm.Headers, RetryCountHeader)
+	exchange := dlx
+	if count < maxRetries {
+		count++
+	} else {
+		exchange = parkingExchange(dlx)
+	}
+
+	pub := cm.publishing()
+	headers := amqp.Table{}
+	for k, v := range pub.Headers {
+		headers[k] = v
+	}
+	headers[RetryCountHeader] = int64(count)
+	pub.Headers = headers
+
+	r := cm.session.rabbus
+	if _, err := r.do(func(l *lane, done published) {
+		l.publish(context.Background(), r.name(exchange), cm.Key, false, pub, done)
+	}); err != nil {
+		return err
+	}
+
+	return cm.Ack(false)
+}
@@ -0,0 +1,91 @@
+package rabbus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRetryQueueArgs(t *testing.T) {
+	c := ListenConfig{Queue: "test_q", QueueArgs: amqp.Table{"x-max-length": int32(10)}}
+	if args := c.queueArgs(); args["x-dead-letter-routing-key"] != nil {
+		t.Fatal("Expected no dead letter exchange without retries")
+	}
+
+	c.RetryDelays = []time.Duration{time.Second, time.Minute}
+	args := c.queueArgs()
+	if args["x-dead-letter-routing-key"] != "test_q.dead" || args["x-max-length"] != int32(10) {
+		t.Fatalf("Expected the queue to dead-letter to test_q.dead, got %v", args)
+	}
+
+	if c.QueueArgs["x-dead-letter-routing-key"] != nil {
+		t.Fatal("Expected the queue args to be left untouched")
+	}
+}
+
+func TestPriorityQueueArgs(t *testing.T) {
+	c := ListenConfig{Queue: "test_q", MaxPriority: 10, QueueArgs: amqp.Table{"x-max-length": int32(10)}}
+	args := c.queueArgs()
+	if args["x-max-priority"] != int32(10) || args["x-max-length"] != int32(10) || args["x-dead-letter-exchange"] != nil {
+		t.Fatalf("Expected the queue to be declared with max priority 10, got %v", args)
+	}
+
+	if c.QueueArgs["x-max-priority"] != nil {
+		t.Fatal("Expected the queue args to be left untouched")
+	}
+}
+
+func TestRetryAttempt(t *testing.T) {
+	if n := retryAttempt(nil); n != 0 {
+		t.Fatalf("Expected no attempts, got %d", n)
+	}
+
+	if n := retryAttempt(amqp.Table{RetryAttemptHeader: int64(2)}); n != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", n)
+	}
+}
+
+func TestConsumerMessageRetry(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1})
+	go r.register()
+	defer close(r.closed)
+
+	s := newSession()
+	s.rabbus = r.rabbus
+	ack := &acknowledger{}
+
+	headers := amqp.Table{"origin": "test"}
+	for i := 0; i < 3; i++ {
+		m := newConsumerMessage(amqp.Delivery{Acknowledger: ack, DeliveryTag: uint64(i + 1), RoutingKey: "test_key", Headers: headers}, s)
+		if err := m.Retry(2, "test_dlx"); err != nil {
+			t.Fatalf("Expected to retry the message %s", err)
+		}
+		headers = ch.published[i].pub.Headers
+	}
+
+	for i, want := range []publishing{
+		{exchange: "test_dlx", key: "test_key"},
+		{exchange: "test_dlx", key: "test_key"},
+		{exchange: "test_dlx.parking", key: "test_key"},
+	} {
+		got := ch.published[i]
+		if got.exchange != want.exchange || got.key != want.key || got.pub.Headers["origin"] != "test" {
+			t.Errorf("Expected retry %d to be published to %s with %s, got %+v", i, want.exchange, want.key, got)
+		}
+	}
+
+	if n := headerCount(ch.published[2].pub.Headers, RetryCountHeader); n != 2 {
+		t.Fatalf("Expected the parked message to be retried 2 times, got %d", n)
+	}
+
+	if ack.acks != 3 || ack.last != "ack" {
+		t.Fatalf("Expected every retried message to be acked, got %d %s", ack.acks, ack.last)
+	}
+
+	m := NewConsumerMessage(Message{Exchange: "test_ex", Key: "test_key"})
+	if err := m.Retry(2, "test_dlx"); err != ErrNotRetryable {
+		t.Fatalf("Expected %v, got %v", ErrNotRetryable, err)
+	}
+}
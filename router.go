@@ -0,0 +1,275 @@
+package rabbus
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// Router manages the bindings of a single queue and dispatches its deliveries to the
+// handler registered for the matching topic pattern.
+// When more than one pattern matches a routing key, the most specific one wins: patterns
+// with fewer "#" wildcards, then fewer "*" wildcards, then more words are preferred, and
+// remaining ties are broken lexically, so the dispatch order never depends on registration order.
+// The embedded Listener stops the router queue consumer.
+type Router struct {
+	sync.RWMutex
+	*Listener
+	exchange string
+	routes   []route
+}
+
+type route struct {
+	pattern string
+	handler func(ConsumerMessage) error
+}
+
+// NewRouter declares the exchange and queue from c and returns a Router dispatching
+// deliveries of that queue to handlers registered by topic pattern. The key from c is ignored and
+// the queue is bound to c.Exchange only, through Router.Handle and Router.Remove, so c.Exchange is required.
+func (r *rabbus) NewRouter(c ListenConfig) (*Router, error) {
+	if err := validateListenConfig(c); err != nil {
+		return nil, err
+	}
+
+	if c.Exchange == "" {
+		return nil, ErrMissingExchange
+	}
+
+	c = r.prefixed(c)
+	rt := &Router{exchange: c.Exchange}
+	cons := &consumer{
+		config:   c,
+		settings: c.settings(),
+		setup:    rt.bind,
+		handle:   rt.dispatch,
+	}
+
+	if err := r.consume(cons); err != nil {
+		return nil, err
+	}
+
+	rt.Listener = r.newListener(cons)
+
+	return rt, nil
+}
+
+// Handle binds the router queue to the exchange using pattern as binding key and registers fn
+// to be called for every delivery matching it. Registering an already known pattern replaces its handler.
+// A nil error returned by fn acks the delivery, ErrReject rejects it and any other error nacks and requeues it.
+func (rt *Router) Handle(pattern string, fn func(ConsumerMessage) error) error {
+	if fn == nil {
+		return ErrMissingHandler
+	}
+
+	// the route is registered first, a delivery matching no route is rejected.
+	prev := rt.register(pattern, fn)
+
+	if err := rt.withChannel(func(ch amqpChannel, queue string) error {
+		return ch.QueueBind(queue, pattern, rt.exchange, false, nil)
+	}); err != nil {
+		if prev != nil {
+			rt.register(pattern, prev)
+		} else {
+			rt.deregister(pattern)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Declare declares t along with the router, e.g. the exchanges and exchange bindings routing
+// messages to the router exchange, so a multi-stage routing graph is declared in one place.
+// Like every declared topology, t is declared again after a reconnect, before the router queue is bound.
+func (rt *Router) Declare(t Topology) error {
+	return rt.rabbus.DeclareTopology(t)
+}
+
+// Remove unbinds pattern from the router queue and deregisters its handler. The handler is kept
+// until the binding is removed, for the deliveries routed by it meanwhile.
+func (rt *Router) Remove(pattern string) error {
+	if err := rt.withChannel(func(ch amqpChannel, queue string) error {
+		return ch.QueueUnbind(queue, pattern, rt.exchange, nil)
+	}); err != nil {
+		return err
+	}
+
+	rt.deregister(pattern)
+
+	return nil
+}
+
+// Unbind removes the binding of every registered pattern from the router queue, the handlers are kept.
+func (rt *Router) Unbind() error {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	return rt.withChannel(func(ch amqpChannel, queue string) error {
+		for _, r := range rt.routes {
+			if err := ch.QueueUnbind(queue, r.pattern, rt.exchange, nil); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// withChannel runs fn on a channel of its own, a broker error closing it leaves the subscription
+// of the router queue alone. Until the queue is subscribed fn is not run, the patterns registered
+// meanwhile are bound along with the subscription.
+func (rt *Router) withChannel(fn func(ch amqpChannel, queue string) error) error {
+	sub, queue := rt.consumer.channel()
+	if sub == nil {
+		return nil
+	}
+
+	ch, err := rt.rabbus.openChannel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	return fn(ch, queue)
+}
+
+// register registers fn for pattern, returning the handler it replaces, nil for a new pattern.
+func (rt *Router) register(pattern string, fn func(ConsumerMessage) error) func(ConsumerMessage) error {
+	rt.Lock()
+	defer rt.Unlock()
+
+	for i := range rt.routes {
+		if rt.routes[i].pattern == pattern {
+			prev := rt.routes[i].handler
+			rt.routes[i].handler = fn
+			return prev
+		}
+	}
+
+	rt.routes = append(rt.routes, route{pattern: pattern, handler: fn})
+	sortRoutes(rt.routes)
+
+	return nil
+}
+
+// deregister removes the handler of pattern.
+func (rt *Router) deregister(pattern string) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	for i := range rt.routes {
+		if rt.routes[i].pattern == pattern {
+			rt.routes = append(rt.routes[:i], rt.routes[i+1:]...)
+			return
+		}
+	}
+}
+
+// bind binds every registered pattern, restoring the bindings after a reconnect.
+func (rt *Router) bind(ch *amqp.Channel, queue string, c ListenConfig) error {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	for _, r := range rt.routes {
+		if err := ch.QueueBind(queue, r.pattern, rt.exchange, false, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (rt *Router) dispatch(msgs <-chan amqp.Delivery, s *session) {
+	for d := range msgs {
+		m := newConsumerMessage(d, s)
+		if m.Stale() {
+			// the channel is gone, the broker redelivers it to the recovered subscription.
+			continue
+		}
+
+		fn := rt.match(m.Key)
+		if fn == nil {
+			// the binding was removed while the delivery was in flight.
+			m.Reject(false)
+			continue
+		}
+
+		settle(m, fn(m))
+	}
+}
+
+func (rt *Router) match(key string) func(ConsumerMessage) error {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	for _, r := range rt.routes {
+		if matchTopic(r.pattern, key) {
+			return r.handler
+		}
+	}
+
+	return nil
+}
+
+// matchTopic reports whether key matches the topic pattern, where "*" substitutes exactly
+// one word and "#" substitutes zero or more words.
+func matchTopic(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchWords(pattern[1:], key[1:])
+	default:
+		return len(key) > 0 && pattern[0] == key[0] && matchWords(pattern[1:], key[1:])
+	}
+}
+
+func sortRoutes(routes []route) {
+	sort.Slice(routes, func(i, j int) bool {
+		return moreSpecific(routes[i].pattern, routes[j].pattern)
+	})
+}
+
+func moreSpecific(a, b string) bool {
+	aw, bw := strings.Split(a, "."), strings.Split(b, ".")
+	if ah, bh := count(aw, "#"), count(bw, "#"); ah != bh {
+		return ah < bh
+	}
+
+	if as, bs := count(aw, "*"), count(bw, "*"); as != bs {
+		return as < bs
+	}
+
+	if len(aw) != len(bw) {
+		return len(aw) > len(bw)
+	}
+
+	return a < b
+}
+
+func count(words []string, w string) int {
+	n := 0
+	for _, word := range words {
+		if word == w {
+			n++
+		}
+	}
+
+	return n
+}
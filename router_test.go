@@ -0,0 +1,125 @@
+package rabbus
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.updated", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders.created.eu", false},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.created.eu", true},
+		{"#.eu", "orders.created.eu", true},
+		{"#", "anything.at.all", true},
+		{"*.created", "created", false},
+	}
+
+	for _, c := range cases {
+		if got := matchTopic(c.pattern, c.key); got != c.match {
+			t.Errorf("Expected matchTopic(%q, %q) to be %v, got %v", c.pattern, c.key, c.match, got)
+		}
+	}
+}
+
+func TestRouterMatchPrefersMostSpecific(t *testing.T) {
+	rt := &Router{}
+	var called string
+	for _, p := range []string{"#", "orders.#", "orders.*", "orders.created"} {
+		pattern := p
+		rt.routes = append(rt.routes, route{pattern: pattern, handler: func(ConsumerMessage) error {
+			called = pattern
+			return nil
+		}})
+	}
+
+	sortRoutes(rt.routes)
+
+	cases := map[string]string{
+		"orders.created":    "orders.created",
+		"orders.updated":    "orders.*",
+		"orders.created.eu": "orders.#",
+		"users.created":     "#",
+	}
+
+	for key, want := range cases {
+		rt.match(key)(ConsumerMessage{})
+		if called != want {
+			t.Errorf("Expected %q to be dispatched to %q, got %q", key, want, called)
+		}
+	}
+}
+
+func TestRouterRegister(t *testing.T) {
+	rt := &Router{}
+	first := func(ConsumerMessage) error { return nil }
+	second := func(ConsumerMessage) error { return ErrReject }
+
+	if prev := rt.register("orders.*", first); prev != nil {
+		t.Fatal("Expected a new pattern to replace no handler")
+	}
+	if prev := rt.register("orders.*", second); prev == nil || prev(ConsumerMessage{}) != nil {
+		t.Fatal("Expected the first handler to be replaced")
+	}
+	if fn := rt.match("orders.created"); fn == nil || fn(ConsumerMessage{}) != ErrReject {
+		t.Fatal("Expected the deliveries to be dispatched to the second handler")
+	}
+
+	rt.deregister("orders.*")
+	if fn := rt.match("orders.created"); fn != nil || len(rt.routes) != 0 {
+		t.Fatalf("Expected the route to be deregistered, got %v", rt.routes)
+	}
+}
+
+func TestNewRouterValidatesConfig(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+
+	_, err := r.NewRouter(ListenConfig{})
+	if verr, ok := err.(*ValidationError); !ok || len(verr.Errors()) != 3 {
+		t.Fatalf("Expected every problem of the config to be reported, got %v", err)
+	}
+}
+
+func TestRouterBindsOnChannelOfItsOwn(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	r.openChannel = func() (amqpChannel, error) { return ch, nil }
+
+	cons := &consumer{config: ListenConfig{Exchange: "orders", Queue: "billing"}}
+	rt := &Router{Listener: r.newListener(cons), exchange: "orders"}
+	handler := func(ConsumerMessage) error { return nil }
+
+	// the queue is not subscribed yet, the pattern is bound along with the subscription.
+	if err := rt.Handle("orders.created", handler); err != nil || len(ch.queueBound) != 0 {
+		t.Fatalf("Expected the pattern to be registered only, got %v and %v", err, ch.queueBound)
+	}
+
+	cons.newSession(&amqp.Channel{}, "billing")
+	if err := rt.Handle("orders.*", handler); err != nil {
+		t.Fatalf("Expected to bind the pattern, got %v", err)
+	}
+	if err := rt.Remove("orders.*"); err != nil {
+		t.Fatalf("Expected to unbind the pattern, got %v", err)
+	}
+
+	if len(ch.queueBound) != 1 || ch.queueBound[0] != "orders->billing" || len(ch.unbound) != 1 {
+		t.Errorf("Expected the pattern to be bound and unbound on a channel of its own, got %v and %v", ch.queueBound, ch.unbound)
+	}
+}
+
+func TestNewRouterRequiresExchange(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{})
+
+	c := ListenConfig{Queue: "billing", Bindings: []Binding{{Exchange: "orders", Kind: "topic", Key: "#"}}}
+	if _, err := r.NewRouter(c); err != ErrMissingExchange {
+		t.Fatalf("Expected %v, got %v", ErrMissingExchange, err)
+	}
+}
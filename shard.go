@@ -0,0 +1,36 @@
+package rabbus
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// EmitSharded emits m asynchronously like EmitAsync, routed to one of shards routing keys, "shard.0"
+// to "shard.<shards-1>", picked from shardKey by Config.ShardHash. Messages with the same shardKey
+// always get the same routing key, so binding each shard queue to its key spreads the load while
+// keeping the messages of a key, e.g. an order id, in the same queue and in order.
+func (r *rabbus) EmitSharded(m Message, shardKey string, shards int) error {
+	if shards < 1 {
+		return ErrInvalidShards
+	}
+
+	hash := r.config.ShardHash
+	if hash == nil {
+		hash = fnv32a
+	}
+
+	m.Key = shardRoutingKey(hash(shardKey) % uint32(shards))
+
+	return r.enqueue(m)
+}
+
+func shardRoutingKey(shard uint32) string {
+	return "shard." + strconv.FormatUint(uint64(shard), 10)
+}
+
+// fnv32a is the default shard hash, stable across processes and versions.
+func fnv32a(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
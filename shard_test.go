@@ -0,0 +1,12 @@
+package rabbus
+
+import (
+	"testing"
+)
+
+func TestShardRoutingKeyIsStable(t *testing.T) {
+	// the hash must never change, or the messages of a key would move to another shard after an upgrade.
+	if key := shardRoutingKey(fnv32a("order-42") % 8); key != "shard.4" {
+		t.Fatalf("Expected shard.4, got %s", key)
+	}
+}
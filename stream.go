@@ -0,0 +1,154 @@
+package rabbus
+
+import (
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// defaultStreamPrefetch is the prefetch of stream consumers without ListenConfig.PrefetchCount,
+// the broker requires one to consume from a stream.
+const defaultStreamPrefetch = 100
+
+// OffsetStore persists the offset of the last processed message of each stream,
+// so a stream consumer resumes from it after a restart.
+type OffsetStore interface {
+	// LoadOffset returns the last offset saved for the stream, ok is false when there is none.
+	LoadOffset(stream string) (offset int64, ok bool, err error)
+	// SaveOffset saves offset as the last processed one of the stream.
+	SaveOffset(stream string, offset int64) error
+}
+
+// StreamListener is a handle on a consumer started by ListenStream.
+type StreamListener struct {
+	*Listener
+
+	sync.Mutex
+	store     OffsetStore
+	stream    string
+	offset    int64
+	processed bool
+}
+
+// Offset returns the offset of the last message processed by the handler, ok is false
+// until the first one.
+func (s *StreamListener) Offset() (offset int64, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	return s.offset, s.processed
+}
+
+// Checkpoint saves the offset of the last processed message to the OffsetStore,
+// the consumer resumes right after it on the next ListenStream. Once stopped, wait for Done
+// before the last Checkpoint, the message being handled is processed then.
+func (s *StreamListener) Checkpoint() error {
+	offset, ok := s.Offset()
+	if !ok {
+		return nil
+	}
+
+	return s.store.SaveOffset(s.stream, offset)
+}
+
+func (s *StreamListener) done(offset int64) {
+	s.Lock()
+	s.offset, s.processed = offset, true
+	s.Unlock()
+}
+
+// args returns the consumer arguments resuming right after the last processed message,
+// or starting from start when none was processed yet.
+func (s *StreamListener) args(start interface{}) amqp.Table {
+	if offset, ok := s.Offset(); ok {
+		start = offset + 1
+	}
+
+	if start == nil {
+		return nil
+	}
+
+	return amqp.Table{"x-stream-offset": start}
+}
+
+// ListenStream consumes the stream queue described by c, calling handler for each message in order.
+// The queue is declared with the stream type, which requires Config.Durable.
+// Streams keep their messages regardless of acknowledgements and never redeliver them, so each
+// message is acked once handled and the consumer position is tracked by offset instead: it starts
+// after the offset saved in store by the last Checkpoint, or at c.StreamOffset when there is none,
+// and a subscription recovered after a reconnect resumes after the last processed message.
+// A nil store keeps the offsets in memory only.
+func (r *rabbus) ListenStream(c ListenConfig, store OffsetStore, handler func(ConsumerMessage)) (*StreamListener, error) {
+	if err := validateListenConfig(c); err != nil {
+		return nil, err
+	}
+
+	if handler == nil {
+		return nil, ErrMissingHandler
+	}
+
+	c = r.prefixed(c)
+	c.QueueArgs = streamArgs(c.QueueArgs)
+
+	if store == nil {
+		store = noopOffsetStore{}
+	}
+
+	sl := &StreamListener{store: store, stream: c.Queue}
+	offset, ok, err := store.LoadOffset(c.Queue)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		sl.done(offset)
+	}
+
+	settings := c.settings()
+	if c.PrefetchCount == 0 {
+		settings.prefetchCount = defaultStreamPrefetch
+	}
+
+	cons := &consumer{
+		config:   c,
+		settings: settings,
+		setup:    bindQueue,
+		args: func() amqp.Table {
+			return sl.args(c.StreamOffset)
+		},
+		handle: func(msgs <-chan amqp.Delivery, s *session) {
+			for d := range msgs {
+				m := newConsumerMessage(d, s)
+				handler(m)
+				m.Ack(false)
+
+				if offset, ok := d.Headers["x-stream-offset"].(int64); ok {
+					sl.done(offset)
+				}
+			}
+		},
+	}
+
+	if err := r.consume(cons); err != nil {
+		return nil, err
+	}
+
+	sl.Listener = r.newListener(cons)
+
+	return sl, nil
+}
+
+// streamArgs returns a copy of args declaring a stream queue.
+func streamArgs(args amqp.Table) amqp.Table {
+	t := amqp.Table{}
+	for k, v := range args {
+		t[k] = v
+	}
+	t["x-queue-type"] = "stream"
+
+	return t
+}
+
+type noopOffsetStore struct{}
+
+func (noopOffsetStore) LoadOffset(string) (int64, bool, error) { return 0, false, nil }
+
+func (noopOffsetStore) SaveOffset(string, int64) error { return nil }
@@ -0,0 +1,66 @@
+package rabbus
+
+import (
+	"testing"
+)
+
+type memoryOffsetStore map[string]int64
+
+func (m memoryOffsetStore) LoadOffset(stream string) (int64, bool, error) {
+	offset, ok := m[stream]
+	return offset, ok, nil
+}
+
+func (m memoryOffsetStore) SaveOffset(stream string, offset int64) error {
+	m[stream] = offset
+	return nil
+}
+
+func TestStreamListenerResumesAfterLastProcessed(t *testing.T) {
+	store := memoryOffsetStore{}
+	sl := &StreamListener{store: store, stream: "test_stream"}
+
+	args := sl.args("first")
+	if args["x-stream-offset"] != "first" {
+		t.Fatalf("Expected to start from first, got %v", args["x-stream-offset"])
+	}
+
+	sl.done(41)
+
+	args = sl.args("first")
+	if args["x-stream-offset"] != int64(42) {
+		t.Fatalf("Expected to resume from 42, got %v", args["x-stream-offset"])
+	}
+
+	if err := sl.Checkpoint(); err != nil {
+		t.Fatalf("Expected to checkpoint offset %s", err)
+	}
+
+	if store["test_stream"] != 41 {
+		t.Fatalf("Expected offset 41 to be saved, got %d", store["test_stream"])
+	}
+}
+
+func TestStreamListenerStopUnbind(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	r.openChannel = func() (amqpChannel, error) { return ch, nil }
+
+	cons := &consumer{config: ListenConfig{Exchange: "events", Kind: "fanout", Queue: "test_stream"}, queue: "test_stream"}
+	r.consumers = []*consumer{cons}
+	sl := &StreamListener{Listener: r.newListener(cons), store: memoryOffsetStore{}, stream: "test_stream"}
+
+	if err := sl.Unbind(); err != nil {
+		t.Fatalf("Expected to unbind the stream, got %v", err)
+	}
+	if len(ch.unbound) != 1 || ch.unbound[0] != "events->test_stream" {
+		t.Errorf("Expected the stream to be unbound from events, got %v", ch.unbound)
+	}
+
+	if err := sl.Stop(); err != nil {
+		t.Fatalf("Expected to stop, got %v", err)
+	}
+	if len(r.consumers) != 0 {
+		t.Errorf("Expected the consumer to be cancelled, got %d consumers", len(r.consumers))
+	}
+}
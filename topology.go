@@ -0,0 +1,164 @@
+package rabbus
+
+import "github.com/streadway/amqp"
+
+// Topology describes exchanges, queues and bindings declared in one place. Every declared
+// topology is declared again after a reconnect, before the consumers are recovered.
+type Topology struct {
+	// Exchanges the exchanges to declare.
+	Exchanges []Exchange
+	// Queues the queues to declare.
+	Queues []Queue
+	// QueueBindings the bindings between queues and exchanges.
+	QueueBindings []QueueBinding
+	// ExchangeBindings the bindings between exchanges.
+	ExchangeBindings []ExchangeBinding
+}
+
+// Exchange carries the fields for declaring an exchange.
+type Exchange struct {
+	// Name the exchange name.
+	Name string
+	// Kind the exchange type.
+	Kind string
+	// Durable indicates if the exchange survives broker restarts.
+	Durable bool
+	// AutoDelete deletes the exchange once it has no bindings left.
+	AutoDelete bool
+	// Internal exchanges only receive messages from other exchanges.
+	Internal bool
+	// Args the exchange arguments.
+	Args amqp.Table
+}
+
+// Queue carries the fields for declaring a queue.
+type Queue struct {
+	// Name the queue name.
+	Name string
+	// Durable indicates if the queue survives broker restarts.
+	Durable bool
+	// AutoDelete deletes the queue once it has no consumers left.
+	AutoDelete bool
+	// Exclusive queues are only accessible by the connection declaring them.
+	Exclusive bool
+	// Args the queue arguments, e.g. x-dead-letter-exchange.
+	Args amqp.Table
+}
+
+// QueueBinding carries the fields for binding a queue to an exchange.
+type QueueBinding struct {
+	// Queue the queue name.
+	Queue string
+	// Exchange the exchange name.
+	Exchange string
+	// Key the binding key.
+	Key string
+	// NoWait does not wait for the broker to confirm the binding.
+	NoWait bool
+	// Args the binding arguments, e.g. the headers to match on headers exchanges.
+	Args amqp.Table
+}
+
+// ExchangeBinding carries the fields for binding an exchange to another one.
+type ExchangeBinding struct {
+	// Destination the exchange messages are routed to.
+	Destination string
+	// Source the exchange messages are routed from.
+	Source string
+	// Key the binding key.
+	Key string
+	// NoWait does not wait for the broker to confirm the binding.
+	NoWait bool
+	// Args the binding arguments, e.g. the headers to match on headers exchanges.
+	Args amqp.Table
+}
+
+// DeclareTopology declares the exchanges, then the queues and finally the bindings from t,
+// which is tracked to be declared again after every reconnect.
+// The declarations run on a dedicated channel so a failure does not close the producer channel.
+// No lock is held while declaring, t is declared again if the connection was renewed meanwhile.
+func (r *rabbus) DeclareTopology(t Topology) error {
+	for {
+		generation := r.Generation()
+		if err := r.declareTopology(r.openChannel, t); err != nil {
+			return err
+		}
+
+		r.Lock()
+		if generation == r.generation {
+			r.topologies = append(r.topologies, t)
+			r.Unlock()
+			return nil
+		}
+		r.Unlock()
+	}
+}
+
+// BindExchange binds destination to source with key, so the messages published to source are routed
+// to destination too, e.g. from an ingress exchange to per-team exchanges without extra queues.
+// Both exchanges must already be declared, e.g. with DeclareTopology. The binding is declared like
+// a topology, so it is declared again after every reconnect.
+func (r *rabbus) BindExchange(destination, source, key string, args amqp.Table) error {
+	return r.DeclareTopology(Topology{
+		ExchangeBindings: []ExchangeBinding{{Destination: destination, Source: source, Key: key, Args: args}},
+	})
+}
+
+// redeclareTopologies declares the tracked topologies again on the channels returned by open.
+func (r *rabbus) redeclareTopologies(open func() (amqpChannel, error), topologies []Topology) {
+	for _, t := range topologies {
+		if err := r.declareTopology(open, t); err != nil {
+			r.config.logf("rabbus: failed to declare the topology again: %s", err)
+		}
+	}
+}
+
+// declareTopology declares t on a channel returned by open, a new one for every attempt
+// as the broker closes channels on errors.
+func (r *rabbus) declareTopology(open func() (amqpChannel, error), t Topology) error {
+	return r.retryTransient(func() error {
+		ch, err := open()
+		if err != nil {
+			return err
+		}
+		defer ch.Close()
+
+		for _, e := range t.Exchanges {
+			if err := ch.ExchangeDeclare(r.name(e.Name), e.Kind, e.Durable, e.AutoDelete, e.Internal, false, e.Args); err != nil {
+				return err
+			}
+		}
+
+		for _, q := range t.Queues {
+			if _, err := ch.QueueDeclare(r.name(q.Name), q.Durable, q.AutoDelete, q.Exclusive, false, q.Args); err != nil {
+				return err
+			}
+		}
+
+		for _, b := range t.QueueBindings {
+			if err := ch.QueueBind(r.name(b.Queue), b.Key, r.name(b.Exchange), b.NoWait, b.Args); err != nil {
+				return err
+			}
+		}
+
+		for _, b := range t.ExchangeBindings {
+			if err := ch.ExchangeBind(r.name(b.Destination), b.Key, r.name(b.Source), b.NoWait, b.Args); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// connChannels returns a func opening channels on conn.
+func connChannels(conn *amqp.Connection) func() (amqpChannel, error) {
+	return func() (amqpChannel, error) {
+		ch, err := conn.Channel()
+		if err != nil {
+			return nil, err
+		}
+
+		return ch, nil
+	}
+}
@@ -0,0 +1,132 @@
+package rabbus
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+var testTopology = Topology{
+	Exchanges:        []Exchange{{Name: "orders", Kind: "topic"}, {Name: "orders_eu", Kind: "topic"}},
+	Queues:           []Queue{{Name: "orders_q"}},
+	QueueBindings:    []QueueBinding{{Queue: "orders_q", Exchange: "orders_eu", Key: "#"}},
+	ExchangeBindings: []ExchangeBinding{{Destination: "orders_eu", Source: "orders", Key: "*.eu"}},
+}
+
+func TestDeclareTopology(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1})
+	r.openChannel = func() (amqpChannel, error) { return ch, nil }
+
+	if err := r.DeclareTopology(testTopology); err != nil {
+		t.Fatalf("Expected to declare the topology %s", err)
+	}
+
+	if len(ch.declared) != 2 || len(ch.bound) != 1 || ch.bound[0] != "orders->orders_eu" {
+		t.Errorf("Expected 2 exchanges and the exchange binding to be declared, got %v and %v", ch.declared, ch.bound)
+	}
+
+	if len(r.topologies) != 1 {
+		t.Errorf("Expected the topology to be tracked, got %d", len(r.topologies))
+	}
+}
+
+func TestDeclareTopologyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		open   func() (amqpChannel, error)
+		opened int
+	}{
+		{"channel", func() (amqpChannel, error) { return nil, errors.New("channel failed") }, 2},
+		{"permanent", func() (amqpChannel, error) {
+			return &fakeChannel{failDeclare: &amqp.Error{Code: amqp.PreconditionFailed}}, nil
+		}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRabbus(&fakeChannel{}, Config{Attempts: 2})
+			opened := 0
+			r.openChannel = func() (amqpChannel, error) {
+				opened++
+				return tt.open()
+			}
+
+			if err := r.DeclareTopology(testTopology); err == nil {
+				t.Fatal("Expected to fail declaring the topology")
+			}
+
+			if opened != tt.opened {
+				t.Errorf("Expected %d channels to be opened, got %d", tt.opened, opened)
+			}
+
+			if len(r.topologies) != 0 {
+				t.Errorf("Expected the topology not to be tracked, got %d", len(r.topologies))
+			}
+		})
+	}
+}
+
+func TestDeclareTopologyWhileReconnecting(t *testing.T) {
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1})
+	opened := 0
+	r.openChannel = func() (amqpChannel, error) {
+		opened++
+		if opened == 1 {
+			// the connection is renewed before the topology is tracked.
+			r.Lock()
+			r.generation++
+			r.Unlock()
+		}
+		return &fakeChannel{}, nil
+	}
+
+	if err := r.DeclareTopology(testTopology); err != nil {
+		t.Fatalf("Expected to declare the topology %s", err)
+	}
+
+	if opened != 2 || len(r.topologies) != 1 {
+		t.Errorf("Expected the topology to be declared again on the new connection and tracked once, got %d and %d", opened, len(r.topologies))
+	}
+}
+
+func TestRedeclareTopologies(t *testing.T) {
+	logger := &recordingLogger{}
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1, Logger: logger})
+	topologies := []Topology{testTopology, {Exchanges: []Exchange{{Name: "bad", Kind: "direct"}}}}
+
+	ch := &fakeChannel{}
+	r.redeclareTopologies(func() (amqpChannel, error) {
+		if len(ch.declared) == 2 {
+			return &fakeChannel{failDeclare: &amqp.Error{Code: amqp.PreconditionFailed}}, nil
+		}
+		return ch, nil
+	}, topologies)
+
+	if len(ch.declared) != 2 || len(ch.bound) != 1 {
+		t.Errorf("Expected the topology to be declared again, got %v and %v", ch.declared, ch.bound)
+	}
+
+	if len(*logger) != 1 {
+		t.Errorf("Expected the failed topology to be logged, got %v", *logger)
+	}
+}
+
+func TestBindExchange(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(&fakeChannel{}, Config{Attempts: 1, NamePrefix: "test_"})
+	r.openChannel = func() (amqpChannel, error) { return ch, nil }
+
+	if err := r.BindExchange("billing", "ingress", "billing.#", nil); err != nil {
+		t.Fatalf("Expected to bind the exchanges %s", err)
+	}
+
+	if len(ch.bound) != 1 || ch.bound[0] != "test_ingress->test_billing" {
+		t.Errorf("Expected the exchanges to be bound, got %v", ch.bound)
+	}
+
+	if len(r.topologies) != 1 {
+		t.Errorf("Expected the binding to be declared again after a reconnect, got %d topologies", len(r.topologies))
+	}
+}
@@ -0,0 +1,53 @@
+package rabbus
+
+import (
+	"context"
+
+	"github.com/streadway/amqp"
+)
+
+// TextMapCarrier carries the trace context in string key-value pairs, it has the method set of the
+// OpenTelemetry propagation.TextMapCarrier.
+type TextMapCarrier interface {
+	// Get returns the value of key, empty when it is not set.
+	Get(key string) string
+	// Set stores value under key.
+	Set(key, value string)
+	// Keys returns the keys set.
+	Keys() []string
+}
+
+// Propagator injects the trace context into the headers of the messages published and extracts it
+// from the ones consumed, e.g. wrapping an OpenTelemetry propagation.TextMapPropagator for W3C
+// tracecontext, which accepts any TextMapCarrier as a propagation.TextMapCarrier. It does not start
+// spans, see Config.StartConsumerSpan for the consumer ones.
+type Propagator interface {
+	// Inject sets the trace context from ctx into carrier.
+	Inject(ctx context.Context, carrier TextMapCarrier)
+	// Extract returns a copy of ctx carrying the trace context read from carrier.
+	Extract(ctx context.Context, carrier TextMapCarrier) context.Context
+}
+
+// HeadersCarrier is the TextMapCarrier of the message headers, only their string values are read.
+type HeadersCarrier amqp.Table
+
+// Get returns the value of the header key when it is a string.
+func (c HeadersCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+// Set sets the header key to value.
+func (c HeadersCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+// Keys returns the names of the headers.
+func (c HeadersCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
@@ -0,0 +1,91 @@
+package rabbus
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+type traceKey struct{}
+
+// fakePropagator propagates the trace id stored in the context under traceKey in the traceparent header.
+type fakePropagator struct{}
+
+func (fakePropagator) Inject(ctx context.Context, carrier TextMapCarrier) {
+	if id, ok := ctx.Value(traceKey{}).(string); ok {
+		carrier.Set("traceparent", id)
+	}
+}
+
+func (fakePropagator) Extract(ctx context.Context, carrier TextMapCarrier) context.Context {
+	return context.WithValue(ctx, traceKey{}, carrier.Get("traceparent"))
+}
+
+func TestSendInjectsTraceContext(t *testing.T) {
+	ch := &fakeChannel{}
+	r := newTestRabbus(ch, Config{Attempts: 1, Propagator: fakePropagator{}})
+
+	headers := amqp.Table{"x-request-id": "42"}
+	m := Message{Exchange: "test_ex", Kind: "direct", Key: "test_key", Headers: headers}
+	r.send(context.WithValue(context.Background(), traceKey{}, "trace-1"), m, true, func(Receipt, error) {})
+
+	m.Context = context.WithValue(context.Background(), traceKey{}, "trace-2")
+	r.send(context.Background(), m, true, func(Receipt, error) {})
+
+	if got := ch.published[0].pub.Headers; got["traceparent"] != "trace-1" || got["x-request-id"] != "42" {
+		t.Fatalf("Expected the trace context of the call along with the headers, got %v", got)
+	}
+
+	if got := ch.published[1].pub.Headers; got["traceparent"] != "trace-2" {
+		t.Fatalf("Expected the trace context of the message, got %v", got)
+	}
+
+	if len(headers) != 1 {
+		t.Fatalf("Expected the message headers to be left untouched, got %v", headers)
+	}
+}
+
+func TestConsumerMessageContext(t *testing.T) {
+	d := amqp.Delivery{Headers: amqp.Table{"traceparent": "trace-1"}}
+
+	cm := newConsumerMessage(d, &session{unacked: map[uint64]struct{}{}, propagator: fakePropagator{}})
+	if id := cm.Context().Value(traceKey{}); id != "trace-1" {
+		t.Errorf("Expected the trace context to be extracted, got %v", id)
+	}
+
+	cm = newConsumerMessage(d, newSession())
+	if id := cm.Context().Value(traceKey{}); id != nil {
+		t.Errorf("Expected an empty context without a propagator, got %v", id)
+	}
+}
+
+func TestHeadersCarrier(t *testing.T) {
+	c := HeadersCarrier{"traceparent": "trace-1", "x-retries": int32(2)}
+	c.Set("tracestate", "vendor=1")
+
+	if c.Get("traceparent") != "trace-1" || c.Get("tracestate") != "vendor=1" || c.Get("x-retries") != "" {
+		t.Errorf("Expected only the string headers to be read, got %v", c)
+	}
+
+	if len(c.Keys()) != 3 {
+		t.Errorf("Expected every header name, got %v", c.Keys())
+	}
+}
+
+func TestConsumerMessageStartsSpan(t *testing.T) {
+	d := amqp.Delivery{Headers: amqp.Table{"traceparent": "trace-1"}}
+	spans := 0
+	s := newSession()
+	s.propagator = fakePropagator{}
+	s.startSpan = func(ctx context.Context, m ConsumerMessage) context.Context {
+		spans++
+		return context.WithValue(ctx, traceKey{}, ctx.Value(traceKey{}).(string)+"/consumer")
+	}
+
+	cm := newConsumerMessage(d, s)
+	cm.Context()
+	if id := cm.Context().Value(traceKey{}); id != "trace-1/consumer" || spans != 1 {
+		t.Errorf("Expected a single consumer span child of the trace context, got %v after %d spans", id, spans)
+	}
+}
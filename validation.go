@@ -0,0 +1,109 @@
+package rabbus
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ValidationError is returned when validating a ListenConfig or a Message finds more than one problem,
+// a single problem is returned as is, e.g. ErrMissingQueue.
+type ValidationError struct {
+	errs []error
+}
+
+// Errors returns every problem found.
+func (e *ValidationError) Errors() []error {
+	return e.errs
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, ", ")
+}
+
+// validation collects the problems found while validating.
+type validation []error
+
+// check records err when failed, unless it is already recorded.
+func (v *validation) check(failed bool, err error) {
+	if !failed {
+		return
+	}
+
+	for _, e := range *v {
+		if e == err {
+			return
+		}
+	}
+
+	*v = append(*v, err)
+}
+
+func (v validation) err() error {
+	switch len(v) {
+	case 0:
+		return nil
+	case 1:
+		return v[0]
+	default:
+		return &ValidationError{errs: v}
+	}
+}
+
+// validateMessage checks m before publishing it, declare tells whether its exchange is declared.
+func validateMessage(m Message, declare bool) error {
+	return checkMessage(m, declare).err()
+}
+
+// checkMessage returns the problems found validating m.
+func checkMessage(m Message, declare bool) validation {
+	var v validation
+	v.check(declare && m.Exchange == "", ErrMissingExchange)
+	v.check(declare && m.Kind == "", ErrMissingKind)
+	v.check(m.DeliveryMode != 0 && m.DeliveryMode != Transient && m.DeliveryMode != Persistent, ErrInvalidDeliveryMode)
+	v.check(m.Expiration != "" && !validExpiration(m.Expiration), ErrInvalidExpiration)
+
+	return v
+}
+
+// validate checks m before publishing it like validateMessage, along with the routing key of the
+// messages to topic exchanges when Config.ValidateRoutingKey is set. No exchange is declared when
+// Config.SkipExchangeDeclare is set, so neither it nor its kind are required then.
+func (r *rabbus) validate(m Message, declare bool) error {
+	v := checkMessage(m, declare && !r.config.SkipExchangeDeclare)
+	v.check(r.config.ValidateRoutingKey && m.Kind == "topic" && !validTopicKey(m.Key), ErrInvalidRoutingKey)
+
+	return v.err()
+}
+
+// validTopicKey reports whether key is made of words delimited by dots, up to 255 bytes, the wildcards
+// * and # being whole words, e.g. orders.*.created, not orders..created nor orders.created*. An empty key
+// is valid, the # bindings match it.
+func validTopicKey(key string) bool {
+	if key == "" {
+		return true
+	}
+
+	if len(key) > 255 {
+		return false
+	}
+
+	for _, w := range strings.Split(key, ".") {
+		if w == "" || (w != "*" && w != "#" && strings.ContainsAny(w, "*#")) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validExpiration reports whether expiration is a number of milliseconds, the broker closes the channel
+// of any other publishing.
+func validExpiration(expiration string) bool {
+	_, err := strconv.ParseUint(expiration, 10, 64)
+	return err == nil
+}
@@ -0,0 +1,110 @@
+package rabbus
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestValidateListenConfigReportsEveryProblem(t *testing.T) {
+	if err := validateListenConfig(ListenConfig{Exchange: "test_ex", Kind: "direct"}); err != ErrMissingQueue {
+		t.Fatalf("Expected %v, got %v", ErrMissingQueue, err)
+	}
+
+	err := validateListenConfig(ListenConfig{Bindings: []Binding{{Key: "a"}, {Key: "b"}}})
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+
+	errs := verr.Errors()
+	if len(errs) != 3 || errs[0] != ErrMissingExchange || errs[1] != ErrMissingKind || errs[2] != ErrMissingQueue {
+		t.Fatalf("Expected every missing field once, got %v", errs)
+	}
+}
+
+func TestValidateListenConfigServerNamedQueue(t *testing.T) {
+	c := ListenConfig{Exchange: "test_ex", Kind: "fanout", Exclusive: true}
+	if err := validateListenConfig(c); err != nil {
+		t.Fatalf("Expected an exclusive queue to be named by the broker, got %v", err)
+	}
+
+	for _, c := range []ListenConfig{
+		{Exchange: "test_ex", Kind: "fanout", Exclusive: true, NoWait: true},
+		{Exchange: "test_ex", Kind: "fanout", Exclusive: true, RetryDelays: []time.Duration{time.Second}},
+		{Exchange: "test_ex", Kind: "fanout", AutoDelete: true},
+		{Exchange: "test_ex", Kind: "fanout", Exclusive: true, SkipDeclare: true},
+	} {
+		if err := validateListenConfig(c); err != ErrMissingQueue {
+			t.Errorf("Expected %v for %+v, got %v", ErrMissingQueue, c, err)
+		}
+	}
+}
+
+func TestValidateListenConfigQueueArgs(t *testing.T) {
+	c := ListenConfig{Exchange: "test_ex", Kind: "direct", Queue: "test_q", QueueArgs: amqp.Table{"x-max-length": int32(10)}}
+	if err := validateListenConfig(c); err != nil {
+		t.Fatalf("Expected valid queue arguments, got %v", err)
+	}
+
+	c.QueueArgs = amqp.Table{"x-max-length": uint(10)}
+	if err := validateListenConfig(c); err == nil {
+		t.Fatal("Expected arguments of unsupported types to be refused")
+	}
+}
+
+func TestValidateMessage(t *testing.T) {
+	if err := validateMessage(Message{Key: "test_key"}, false); err != nil {
+		t.Fatalf("Expected a message to the default exchange to be valid, got %v", err)
+	}
+
+	err := validateMessage(Message{DeliveryMode: 3}, true)
+	if verr, ok := err.(*ValidationError); !ok || len(verr.Errors()) != 3 {
+		t.Fatalf("Expected 3 problems, got %v", err)
+	}
+
+	if err := validateMessage(Message{Key: "test_key", Expiration: "60000"}, false); err != nil {
+		t.Fatalf("Expected an expiration in milliseconds to be valid, got %v", err)
+	}
+
+	for _, expiration := range []string{"1m", "-1", "1.5"} {
+		if err := validateMessage(Message{Key: "test_key", Expiration: expiration}, false); err != ErrInvalidExpiration {
+			t.Errorf("Expected %v for %q, got %v", ErrInvalidExpiration, expiration, err)
+		}
+	}
+}
+
+func TestValidTopicKey(t *testing.T) {
+	for _, key := range []string{"", "orders", "orders.created", "orders.*.created", "orders.#", "#", "*.*"} {
+		if !validTopicKey(key) {
+			t.Errorf("Expected %q to be valid", key)
+		}
+	}
+
+	for _, key := range []string{"orders.", ".orders", "orders..created", "orders.created*", "orders.#eu", strings.Repeat("a", 256)} {
+		if validTopicKey(key) {
+			t.Errorf("Expected %q to be invalid", key)
+		}
+	}
+}
+
+func TestValidateRoutingKey(t *testing.T) {
+	m := Message{Exchange: "orders", Kind: "topic", Key: "orders..created"}
+
+	r := newTestRabbus(&fakeChannel{}, Config{})
+	if err := r.validate(m, true); err != nil {
+		t.Fatalf("Expected the routing key not to be validated by default, got %v", err)
+	}
+
+	r.config.ValidateRoutingKey = true
+	if err := r.validate(m, true); err != ErrInvalidRoutingKey {
+		t.Fatalf("Expected %v, got %v", ErrInvalidRoutingKey, err)
+	}
+
+	m.Kind = "direct"
+	if err := r.validate(m, true); err != nil {
+		t.Fatalf("Expected the routing key to a direct exchange not to be validated, got %v", err)
+	}
+}